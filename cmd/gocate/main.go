@@ -1,16 +1,33 @@
 // Command gocate is a locate replacement: it walks a filesystem tree, stores
 // file metadata and content hashes in an embedded SQL database, and searches
 // files by name or lists duplicates by content hash.
+//
+// It exits with status 0 on success, 1 on an error, 3 when -updatedb finished
+// but some paths could not be indexed, and 130 when interrupted.
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime/pprof"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"github.com/mattn/go-isatty"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
@@ -21,24 +38,102 @@ import (
 var (
 	updatedbFlag = flag.Bool("updatedb", false, "update the database")
 	configDir    = flag.String("config", filepath.Join(os.Getenv("HOME"), ".gocate"), "directory to store the file DB")
-	updatePath   = flag.String("path", ".", "path to walk and index (with -updatedb)")
+	updatePath   = flag.String("path", ".", "path to walk and index (with -updatedb or -prune)")
+	pruneFlag    = flag.Bool("prune", false, "remove rows under -path for files that no longer exist, without re-indexing")
 	printDupes   = flag.Bool("dupes", false, "print groups of duplicate files (by content hash)")
 	dupesScript  = flag.Bool("dupes-script", false, "like -dupes but emit a shell script that replaces each duplicate with a hardlink to a canonical original")
-	showStats    = flag.Bool("stats", false, "print DB stats and dump all rows")
-	quick        = flag.Bool("quick", false, "quick update: skip files already in the database")
+	exportMan    = flag.Bool("export-manifest", false, "print a sha256sum/xxhsum-compatible manifest of the -hash-algo digests indexed under -path")
+	verifyMan    = flag.String("verify-manifest", "", "check the checksum manifest in this file against the index for -path (or the disk, with -verify-disk)")
+	verifyDisk   = flag.Bool("verify-disk", false, "with -verify-manifest, hash the files on disk instead of using the indexed digests")
+	scrubFlag    = flag.Bool("scrub", false, "re-hash indexed files and report silent corruption as JSON lines, resuming where an unfinished scrub stopped")
+	scrubRate    = flag.String("scrub-rate", "", "with -scrub, read at most this many bytes per second (e.g. 50M; default -rate)")
+	scrubFor     = flag.Duration("scrub-for", 0, "with -scrub, stop after this long and resume from there next time (e.g. 2h)")
+	scrubRestart = flag.Bool("scrub-restart", false, "with -scrub, start from the first file rather than where the last scrub stopped")
+	showRuns     = flag.Bool("runs", false, "list indexing runs, newest first, with their root, options, timings and counts")
+	showStats    = flag.Bool("stats", false, "print DB stats and dump all rows with their stat metadata")
+	quick        = flag.Bool("quick", false, "quick update: skip files already in the database, even if they changed")
+	rehash       = flag.Bool("rehash", false, "hash every file again, not only files whose size, mtime or inode changed")
+	failFast     = flag.Bool("fail-fast", false, "with -updatedb, stop at the first path that cannot be indexed")
+	maxErrors    = flag.Int("max-errors", 0, "with -updatedb, stop once this many paths could not be indexed (0 for no limit)")
+	resume       = flag.Bool("resume", false, "with -updatedb, continue the last run of -path from its checkpoint if it did not finish")
+	readRate     = flag.String("rate", "", "read files to hash them at most this many bytes per second in total (e.g. 50M)")
+	devWorkers   = flag.Int("device-workers", 0, "hash at most this many files at once from any one device (0 for no limit beyond the worker count)")
+	idle         = flag.Bool("idle", false, "run at idle CPU and I/O priority, like nice -n19 ionice -c3")
+	progress     = flag.Bool("progress", stderrIsTerminal(), "with -updatedb, report progress: a status line on a terminal, where it is on by default, a line a minute otherwise")
 	noHash       = flag.Bool("no-hash", false, "don't hash files, just record path/size/modtime")
+	sizeFirst    = flag.Bool("size-first", false, "only hash files that can have duplicates: imohash on size collisions, the full digest on size and imohash collisions")
+	hashAlgo     = flag.String("hash-algo", index.DefaultHashAlgo, "full-content digest to record: "+strings.Join(index.HashAlgos(), ", "))
+	history      = flag.Bool("history", false, "with -updatedb, record which files were added, modified or deleted (see -changes)")
+	historyKeep  = flag.Duration("history-keep", 90*24*time.Hour, "with -history, drop history older than this (0 to keep it all)")
+	showChanges  = flag.Bool("changes", false, "list files added (A), modified (M) and deleted (D) by the last -history run, or since -since")
+	since        = flag.String("since", "", "with -changes, report changes after this run ID (see -runs) or within this duration (e.g. 24h)")
 	hostname     = flag.String("hostname", "", "custom hostname to use for the database")
+	hostFilter   = flag.String("host", "", `only show rows indexed on this host (default: this host, "all" for every host)`)
+	limit        = flag.Int("limit", 0, "print at most this many results, duplicate groups or rows (0 for no limit)")
+	pruneNames   = flag.String("prunenames", "", "space-separated directory names not to descend into (e.g. \".git node_modules\")")
+	prunePaths   = flag.String("prunepaths", "", "space-separated directory paths not to descend into (e.g. \"/proc /sys\")")
+	pruneFS      = flag.String("prunefs", strings.Join(index.DefaultPruneFS, " "), "space-separated filesystem types whose mounts are not descended into (\"\" for none)")
+	updatedbConf = flag.String("updatedb-conf", "", "also apply the PRUNE* settings of this updatedb.conf file (e.g. "+index.DefaultUpdatedbConf+")")
+	xdev         = flag.Bool("xdev", false, "don't descend into directories on other filesystems than -path")
 	profile      = flag.Bool("profile", false, "write a CPU profile to default.pgo")
+
+	excludes       listFlag
+	excludeRegexps listFlag
 )
 
+func init() {
+	flag.Var(&excludes, "exclude", "glob of files and directories to leave out of the index; a glob with a / matches the full path (repeatable)")
+	flag.Var(&excludeRegexps, "exclude-regex", "regular expression matched against full paths to leave out of the index (repeatable)")
+}
+
+// listFlag is a flag.Value collecting every occurrence of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ", ") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// stdout buffers result output. Results are streamed from the store as they are
+// found, so the buffer is what keeps a large listing from costing one write per
+// line; a consumer that goes away (e.g. `| head`) ends the process on the next
+// flush.
+var stdout = bufio.NewWriter(os.Stdout)
+
+// errPartial is returned by run when it finished, but -updatedb could not
+// index some paths. They have been reported already.
+var errPartial = errors.New("some paths could not be indexed")
+
 func main() {
-	if err := run(); err != nil {
+	// The first SIGINT or SIGTERM cancels ctx: indexing stops walking, lets
+	// the files being hashed finish or abandons them, and writes what it has
+	// before the DB is closed. A second signal kills the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := run(ctx)
+	if ferr := stdout.Flush(); ferr != nil && err == nil {
+		err = fmt.Errorf("write output: %w", ferr)
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Warn().Msg("interrupted")
+		os.Exit(130)
+	}
+	if errors.Is(err, errPartial) {
+		os.Exit(3)
+	}
+	if err != nil {
 		log.Error().Err(err).Msg("fatal error")
 		os.Exit(1)
 	}
 }
 
-func run() error {
+func run(ctx context.Context) error {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	zerolog.SetGlobalLevel(zerolog.WarnLevel)
 
@@ -52,7 +147,21 @@ func run() error {
 		defer stop()
 	}
 
-	s, err := store.Open(*configDir, *hostname)
+	if *idle {
+		if err := index.IdlePriority(); err != nil {
+			log.Warn().Err(err).Msg("cannot lower the priority; running at the normal one")
+		}
+	}
+
+	// Only indexing writes to the DB; searches, -dupes and -stats read a
+	// snapshot so they work alongside a running -updatedb and need no write
+	// access to -config. (-dupes may still write; see hashForDupes.)
+	writable := *updatedbFlag || *pruneFlag || *scrubFlag
+	open := store.OpenReadOnly
+	if writable {
+		open = store.Open
+	}
+	s, err := open(*configDir, *hostname)
 	if err != nil {
 		return err
 	}
@@ -62,12 +171,41 @@ func run() error {
 		}
 	}()
 
-	if *updatedbFlag {
+	partial := false // -updatedb could not index some paths
+	if *updatedbFlag || *pruneFlag {
 		root, err := filepath.Abs(*updatePath)
 		if err != nil {
 			return fmt.Errorf("resolve path %q: %w", *updatePath, err)
 		}
-		if err := index.Run(s, root, index.Options{Hash: !*noHash, Quick: *quick}); err != nil {
+		opts, err := indexOptions()
+		if err != nil {
+			return err
+		}
+		// -updatedb prunes as part of its walk; -prune alone only prunes.
+		if *updatedbFlag {
+			opts.Progress, opts.ProgressInterval = progressReporter()
+			var res index.Result
+			res, err = index.Run(ctx, s, root, opts)
+			partial = reportFailures(res)
+		} else {
+			err = index.Prune(ctx, s, root, opts)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if *scrubFlag {
+		if err := scrub(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	if *printDupes || *dupesScript {
+		if err := checkDupAlgo(s); err != nil {
+			return err
+		}
+		if s, err = hashForDupes(ctx, s, writable); err != nil {
 			return err
 		}
 	}
@@ -84,18 +222,99 @@ func run() error {
 		}
 	}
 
+	if *exportMan {
+		if err := exportManifest(s); err != nil {
+			return err
+		}
+	}
+
+	if *verifyMan != "" {
+		if err := verifyManifest(ctx, s); err != nil {
+			return err
+		}
+	}
+
 	if *showStats {
 		if err := showInfo(s); err != nil {
 			return err
 		}
 	}
 
+	if *showChanges {
+		if err := listChanges(s); err != nil {
+			return err
+		}
+	}
+
+	if *showRuns {
+		if err := listRuns(s); err != nil {
+			return err
+		}
+	}
+
 	if flag.NArg() > 0 {
+		warnIfUncovered(s)
 		if err := search(s, flag.Arg(0)); err != nil {
 			return err
 		}
 	}
 
+	if partial {
+		return errPartial
+	}
+	return nil
+}
+
+// indexOptions builds the index.Options selected by the command-line flags.
+func indexOptions() (index.Options, error) {
+	opts := index.Options{
+		Hash:      !*noHash,
+		Quick:     *quick,
+		Rehash:    *rehash,
+		SizeFirst: *sizeFirst,
+		HashAlgo:  *hashAlgo,
+		Resume:    *resume,
+		FailFast:  *failFast,
+		MaxErrors: *maxErrors,
+
+		History:     *history,
+		HistoryKeep: *historyKeep,
+
+		Exclude:    excludes,
+		PruneNames: strings.Fields(*pruneNames),
+		PrunePaths: strings.Fields(*prunePaths),
+		PruneFS:    strings.Fields(*pruneFS),
+
+		OneFilesystem: *xdev,
+	}
+	if err := throttleOptions(&opts); err != nil {
+		return opts, err
+	}
+	for _, expr := range excludeRegexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return opts, fmt.Errorf("-exclude-regex %q: %w", expr, err)
+		}
+		opts.ExcludeRegexp = append(opts.ExcludeRegexp, re)
+	}
+	if *updatedbConf != "" {
+		conf, err := index.ReadUpdatedbConf(*updatedbConf)
+		if err != nil {
+			return opts, err
+		}
+		conf.Apply(&opts)
+	}
+	return opts, nil
+}
+
+// throttleOptions sets the options of opts that pace reads: -rate and
+// -device-workers.
+func throttleOptions(opts *index.Options) error {
+	rate, err := parseSize(*readRate)
+	if err != nil {
+		return fmt.Errorf("-rate: %w", err)
+	}
+	opts.BytesPerSec, opts.DeviceWorkers = rate, *devWorkers
 	return nil
 }
 
@@ -118,23 +337,222 @@ func startProfile(path string) (func(), error) {
 }
 
 func search(s *store.Store, pattern string) error {
-	files, err := s.Search(pattern)
+	n := 0
+	for f, err := range s.SearchSeq(*hostFilter, pattern) {
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(stdout, displayPath(f)); err != nil {
+			return err
+		}
+		if n++; limitReached(n) {
+			break
+		}
+	}
+	return nil
+}
+
+// warnIfUncovered warns when the current directory lies outside every tree
+// indexed on this host, since a search run there is likely to be looking for
+// files gocate has never seen. Databases without recorded runs, written by
+// older versions, are given the benefit of the doubt.
+func warnIfUncovered(s *store.Store) {
+	if *hostFilter != "" && *hostFilter != s.Hostname() {
+		return
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	runs, err := s.Runs("")
+	if err != nil {
+		log.Warn().Err(err).Msg("cannot list indexing runs")
+		return
+	}
+	indexed := false
+	for _, r := range runs {
+		if r.Status != store.RunDone {
+			continue
+		}
+		indexed = true
+		if rel, err := filepath.Rel(r.Root, cwd); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return
+		}
+	}
+	if indexed {
+		log.Warn().Str("dir", cwd).Msg("no indexed tree covers the current directory; results may be missing files here (see -runs, -updatedb -path)")
+	}
+}
+
+// listChanges prints the net change to each file over the period -since
+// selects, as a tab-separated letter (A, M or D) and path. Without -since it
+// reports the changes recorded by the last finished -history run alone, i.e.
+// what changed under its root since the scan before it.
+func listChanges(s *store.Store) error {
+	var afterRun, throughRun int64
+	var from time.Time
+	switch {
+	case *since == "":
+		runs, err := s.Runs(*hostFilter)
+		if err != nil {
+			return err
+		}
+		r, ok := index.LastHistoryRun(runs)
+		if !ok {
+			return errors.New("-changes: no finished -history run yet")
+		}
+		afterRun, throughRun = r.ID-1, r.ID
+	default:
+		if id, err := strconv.ParseInt(*since, 10, 64); err == nil {
+			afterRun = id
+		} else if d, err := time.ParseDuration(*since); err == nil {
+			from = time.Now().Add(-d)
+		} else {
+			return fmt.Errorf("-since %q: want a run ID or a duration", *since)
+		}
+	}
+
+	changes, err := s.Changes(*hostFilter, afterRun, throughRun, from)
 	if err != nil {
 		return err
 	}
-	for _, f := range files {
-		fmt.Println(f.Path)
+	letters := map[store.ChangeKind]string{store.Added: "A", store.Modified: "M", store.Deleted: "D"}
+	for i, c := range store.NetChanges(changes) {
+		path := displayPath(store.FileInfo{Host: c.Host, Path: c.Path})
+		if _, err := fmt.Fprintf(stdout, "%s\t%s\n", letters[c.Kind], path); err != nil {
+			return err
+		}
+		if limitReached(i + 1) {
+			break
+		}
 	}
 	return nil
 }
 
-func showDuplicates(s *store.Store) error {
-	groups, err := s.Duplicates()
+// listRuns prints one tab-separated line per indexing run: ID, host, root,
+// status, start time, duration, entries seen, hashed, inserted, updated and
+// errored, and the options, followed for a resumed run by the run it resumed.
+func listRuns(s *store.Store) error {
+	runs, err := s.Runs(*hostFilter)
+	if err != nil {
+		return err
+	}
+	for i, r := range runs {
+		took := ""
+		if !r.Finished.IsZero() {
+			took = r.Finished.Sub(r.Started).Round(time.Millisecond).String()
+		}
+		options := r.Options
+		if r.Resumed != 0 {
+			options += " resumed=" + strconv.FormatInt(r.Resumed, 10)
+		}
+		if _, err := fmt.Fprintf(stdout, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			r.ID, r.Host, r.Root, r.Status, formatTime(r.Started), took,
+			r.Seen, r.Hashed, r.Inserted, r.Updated, r.Errors, strings.TrimSpace(options)); err != nil {
+			return err
+		}
+		if limitReached(i + 1) {
+			break
+		}
+	}
+	return nil
+}
+
+// limitReached reports whether n results have satisfied -limit.
+func limitReached(n int) bool {
+	return *limit > 0 && n >= *limit
+}
+
+// displayPath returns f's path, prefixed with its host when rows from every
+// host are shown, since the same path can then appear more than once.
+func displayPath(f store.FileInfo) string {
+	if *hostFilter == store.AllHosts {
+		return f.Host + ":" + f.Path
+	}
+	return f.Path
+}
+
+// checkDupAlgo refuses -dupes and -dupes-script when the digests they would
+// compare are from an algorithm that different files can share, since
+// linking such "duplicates" together would destroy one of them.
+func checkDupAlgo(s *store.Store) error {
+	algo, err := s.DupAlgo(*hostFilter)
 	if err != nil {
 		return err
 	}
-	for _, files := range groups {
-		fmt.Println(strings.Join(files, " "))
+	if algo == "" {
+		algo = *hashAlgo
+	}
+	if err := index.CheckDupAlgo(algo); err != nil {
+		return fmt.Errorf("-dupes: %w; re-index with -rehash -hash-algo %s", err, index.DefaultHashAlgo)
+	}
+	return nil
+}
+
+// hashForDupes makes sure -dupes sees every duplicate on this host. Rows
+// indexed with -no-hash lack the hashes duplicates are grouped by, so the
+// files among them whose size collides are hashed now and the hashes written
+// back; files with a unique size are never read. Writing needs the DB open
+// for writing, so a read-only s is swapped for a writable store, which is
+// returned. If that fails, e.g. because an -updatedb is running, duplicates
+// are reported from the hashes already recorded. Missing digests are computed
+// with the algorithm duplicates are compared by, or -hash-algo if the DB holds
+// no digests yet.
+func hashForDupes(ctx context.Context, s *store.Store, writable bool) (*store.Store, error) {
+	if *hostFilter != "" && *hostFilter != store.AllHosts && *hostFilter != s.Hostname() {
+		return s, nil // another host's files cannot be read from here
+	}
+	algo, err := s.DupAlgo(s.Hostname())
+	if err != nil {
+		return s, err
+	}
+	if algo == "" {
+		algo = *hashAlgo
+	}
+	opts := index.Options{HashAlgo: algo}
+	if err := throttleOptions(&opts); err != nil {
+		return s, err
+	}
+	need, err := index.NeedsHashing(s, opts)
+	if err != nil || !need {
+		return s, err
+	}
+	if !writable {
+		w, err := store.Open(*configDir, *hostname)
+		if err != nil {
+			log.Warn().Err(err).Msg("cannot open the db to hash unhashed duplicate candidates; duplicates may be incomplete")
+			return s, nil
+		}
+		if err := s.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close db")
+		}
+		s = w
+	}
+	return s, index.HashCollisions(ctx, s, opts)
+}
+
+// showDuplicates prints one line per duplicate group listing each copy of the
+// content once. Paths hard-linked to the same inode are one copy: only the
+// first is shown, followed by the file's link count.
+func showDuplicates(s *store.Store) error {
+	n := 0
+	for g, err := range s.DuplicatesSeq(*hostFilter) {
+		if err != nil {
+			return err
+		}
+		copies := make([]string, len(g.Copies))
+		for i, links := range g.Copies {
+			copies[i] = displayPath(links[0])
+			if nlink := links[0].Nlink; nlink > 1 {
+				copies[i] += fmt.Sprintf(" (%d links)", nlink)
+			}
+		}
+		if _, err := fmt.Fprintln(stdout, strings.Join(copies, " ")); err != nil {
+			return err
+		}
+		if n++; limitReached(n) {
+			break
+		}
 	}
 	return nil
 }
@@ -144,26 +562,36 @@ func showDuplicates(s *store.Store) error {
 // (canonical) member of the group. The canonical file is left untouched, so no
 // content is lost and only one inode's worth of disk is consumed per group.
 // The first member of each group is chosen deterministically (sorted), so
-// re-running the script after more files have been added is stable.
+// re-running the script after more files have been added is stable. Paths
+// already linked to the canonical file are left alone, and once a group is
+// fully linked it is no longer reported, so a re-indexed tree yields an empty
+// script. Links only make sense within one machine, so the script covers a
+// single host.
 func showDuplicatesScript(s *store.Store) error {
-	groups, err := s.Duplicates()
-	if err != nil {
-		return err
+	if *hostFilter == store.AllHosts {
+		return fmt.Errorf("-dupes-script needs a single -host, not %q", store.AllHosts)
 	}
-	if len(groups) == 0 {
-		return nil
-	}
-	fmt.Println("#!/bin/sh")
-	fmt.Println("# Auto-generated by `gocate -dupes-script`. Replaces each duplicate")
-	fmt.Println("# with a hardlink to the first path in its group. Review before running.")
-	fmt.Println("set -eu")
-	for _, files := range groups {
-		canonical := files[0]
-		for _, dup := range files[1:] {
-			if dup == canonical {
-				continue
+	n := 0
+	for g, err := range s.DuplicatesSeq(*hostFilter) {
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Fprintln(stdout, "#!/bin/sh")
+			fmt.Fprintln(stdout, "# Auto-generated by `gocate -dupes-script`. Replaces each duplicate")
+			fmt.Fprintln(stdout, "# with a hardlink to the first path in its group. Review before running.")
+			fmt.Fprintln(stdout, "set -eu")
+		}
+		canonical := g.Copies[0][0].Path
+		for _, links := range g.Copies[1:] {
+			for _, dup := range links {
+				if _, err := fmt.Fprintf(stdout, "ln -f -- %s %s\n", shellQuote(canonical), shellQuote(dup.Path)); err != nil {
+					return err
+				}
 			}
-			fmt.Printf("ln -f -- %s %s\n", shellQuote(canonical), shellQuote(dup))
+		}
+		if n++; limitReached(n) {
+			break
 		}
 	}
 	return nil
@@ -175,19 +603,239 @@ func shellQuote(s string) string {
 	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
 }
 
-func showInfo(s *store.Store) error {
-	name, tables, err := s.Info()
+// scrub runs index.Scrub, printing every file that is not OK as a line of
+// JSON as soon as it is found, then a summary line. Finding corrupt files
+// fails the run, so a scheduled scrub can alert on the exit status.
+func scrub(ctx context.Context, s *store.Store) error {
+	flagName, v := "-scrub-rate", *scrubRate
+	if v == "" {
+		flagName, v = "-rate", *readRate
+	}
+	rate, err := parseSize(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", flagName, err)
+	}
+	enc := json.NewEncoder(stdout)
+	st, err := index.Scrub(ctx, s, index.ScrubOptions{
+		BytesPerSec: rate,
+		Duration:    *scrubFor,
+		Restart:     *scrubRestart,
+	}, func(ev index.ScrubEvent) error {
+		if ev.Status == index.ScrubOK {
+			return nil
+		}
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+		return stdout.Flush()
+	})
 	if err != nil {
 		return err
 	}
-	fmt.Printf("db: %s tables: %s\n", name, strings.Join(tables, ", "))
+	if err := enc.Encode(struct {
+		Summary index.ScrubStats `json:"summary"`
+	}{st}); err != nil {
+		return err
+	}
+	if st.Corrupt > 0 {
+		return fmt.Errorf("scrub found %d corrupt files", st.Corrupt)
+	}
+	return nil
+}
+
+// reportFailures logs, for each kind of error, how many paths an indexing run
+// could not index and the first few of them. It reports whether there were
+// any.
+func reportFailures(res index.Result) bool {
+	kinds := slices.Sorted(maps.Keys(res.Errors))
+	for _, kind := range kinds {
+		var paths []string
+		for _, e := range res.Samples[kind] {
+			paths = append(paths, e.Path)
+		}
+		log.Warn().Str("kind", string(kind)).Int64("count", res.Errors[kind]).Strs("first", paths).
+			Msg("paths not indexed")
+	}
+	return len(kinds) > 0
+}
+
+// stderrIsTerminal reports whether stderr is a terminal, where -progress is on
+// by default.
+func stderrIsTerminal() bool {
+	fd := os.Stderr.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
 
-	files, err := s.Dump()
+// progressReporter returns the index.Options.Progress callback and interval
+// for -progress. On a terminal it redraws one status line on stderr; otherwise,
+// where -progress must be asked for, it writes a line every minute.
+func progressReporter() (func(index.Progress), time.Duration) {
+	if !*progress {
+		return nil, 0
+	}
+	if !stderrIsTerminal() {
+		return func(p index.Progress) {
+			fmt.Fprintln(os.Stderr, progressLine(p, math.MaxInt))
+		}, time.Minute
+	}
+	return func(p index.Progress) {
+		end := ""
+		if p.Done {
+			end = "\n"
+		}
+		// \x1b[K clears what is left of a longer earlier line.
+		fmt.Fprintf(os.Stderr, "\r%s\x1b[K%s", progressLine(p, 79), end)
+	}, 250 * time.Millisecond
+}
+
+// progressLine formats p in at most width characters, shortening the path
+// from the left to fit.
+func progressLine(p index.Progress, width int) string {
+	stats := fmt.Sprintf("%d dirs, %d files, %d hashed (%s, %s/s) in %s ",
+		p.Dirs, p.Files, p.Hashed, formatSize(p.HashedBytes), formatSize(int64(p.BytesPerSec())),
+		p.Elapsed.Round(time.Second))
+	room := width - utf8.RuneCountInString(stats)
+	path := []rune(p.Path)
+	switch {
+	case room < 2:
+		path = nil
+	case len(path) > room:
+		path = append([]rune("…"), path[len(path)-room+1:]...)
+	}
+	return stats + string(path)
+}
+
+// formatSize formats a byte count in powers of 1024, like parseSize reads.
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, unit := float64(n)/1024, 0
+	for f >= 1024 && unit < 4 {
+		f, unit = f/1024, unit+1
+	}
+	return fmt.Sprintf("%.1f %ciB", f, "KMGTP"[unit])
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix (powers
+// of 1024). An empty string is 0.
+func parseSize(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	digits, mult := v, int64(1)
+	if i := strings.IndexByte("KMGT", strings.ToUpper(v)[len(v)-1]); i >= 0 {
+		digits, mult = v[:len(v)-1], 1<<(10*(i+1))
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n * mult, nil
+}
+
+// exportManifest prints the manifest of the files indexed under -path.
+func exportManifest(s *store.Store) error {
+	root, err := filepath.Abs(*updatePath)
+	if err != nil {
+		return fmt.Errorf("resolve path %q: %w", *updatePath, err)
+	}
+	skipped, err := index.WriteManifest(stdout, s, root, index.Options{HashAlgo: *hashAlgo})
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		log.Warn().Int("files", skipped).Str("algo", *hashAlgo).
+			Msg("files indexed without a digest of this algorithm were left out; re-index with -hash-algo to include them")
+	}
+	return nil
+}
+
+// verifyManifest checks the -verify-manifest file, printing a line for each
+// file that is not OK, in the style of sha256sum -c, and failing if any listed
+// file is missing, differs or could not be checked. Files under -path that the
+// manifest does not list are printed as EXTRA but do not fail the check.
+func verifyManifest(ctx context.Context, s *store.Store) error {
+	root, err := filepath.Abs(*updatePath)
+	if err != nil {
+		return fmt.Errorf("resolve path %q: %w", *updatePath, err)
+	}
+	f, err := os.Open(*verifyMan)
+	if err != nil {
+		return fmt.Errorf("open manifest: %w", err)
+	}
+	entries, err := index.ReadManifest(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	opts, err := indexOptions()
 	if err != nil {
 		return err
 	}
-	for _, f := range files {
-		fmt.Printf("%s\t%d\t%s\t%s\t%s\n", f.Path, f.Size, f.ModTime.Format("2006-01-02 15:04:05"), f.Imohash, f.XXH3Hash)
+	var v *index.Verification
+	if *verifyDisk {
+		v, err = index.VerifyManifestDisk(ctx, root, entries, opts)
+	} else {
+		v, err = index.VerifyManifest(s, root, entries, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, r := range []struct {
+		status string
+		paths  []string
+	}{
+		{"FAILED", v.Mismatched},
+		{"MISSING", v.Missing},
+		{"UNVERIFIED", v.Unverified},
+		{"EXTRA", v.Extra},
+	} {
+		for _, path := range r.paths {
+			if _, err := fmt.Fprintf(stdout, "%s: %s\n", path, r.status); err != nil {
+				return err
+			}
+		}
+	}
+	if v.Failed() {
+		return fmt.Errorf("manifest verification failed: %d OK, %d mismatched, %d missing, %d unverified",
+			v.OK, len(v.Mismatched), len(v.Missing), len(v.Unverified))
 	}
 	return nil
 }
+
+// showInfo prints DB stats, then every row as tab-separated host, path, size,
+// mtime, imohash, digest, digest algorithm, type, mode, uid, gid, inode, device, nlink and ctime.
+func showInfo(s *store.Store) error {
+	name, tables, err := s.Info()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "db: %s tables: %s\n", name, strings.Join(tables, ", "))
+
+	n := 0
+	for f, err := range s.DumpSeq(*hostFilter) {
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(stdout, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			f.Host, f.Path, f.Size, formatTime(f.ModTime), f.Imohash, f.Hash, f.HashAlgo,
+			f.Type, f.Mode, f.UID, f.GID, f.Inode, f.Device, f.Nlink, formatTime(f.ChangeTime)); err != nil {
+			return err
+		}
+		if n++; limitReached(n) {
+			break
+		}
+	}
+	return nil
+}
+
+// formatTime formats a row timestamp, leaving unknown (zero) times blank.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
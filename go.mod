@@ -4,8 +4,11 @@ go 1.25.0
 
 require (
 	github.com/kalafut/imohash v1.1.1
+	github.com/mattn/go-isatty v0.0.24
 	github.com/rs/zerolog v1.35.1
+	github.com/zeebo/blake3 v0.2.4
 	github.com/zeebo/xxh3 v1.1.0
+	golang.org/x/sys v0.47.0
 	modernc.org/ql v1.5.2
 )
 
@@ -13,10 +16,8 @@ require (
 	github.com/edsrzf/mmap-go v1.2.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.4.0 // indirect
 	github.com/mattn/go-colorable v0.1.15 // indirect
-	github.com/mattn/go-isatty v0.0.24 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/twmb/murmur3 v1.1.8 // indirect
-	golang.org/x/sys v0.47.0 // indirect
 	modernc.org/b v1.1.0 // indirect
 	modernc.org/db v1.3.1 // indirect
 	modernc.org/file v1.1.4 // indirect
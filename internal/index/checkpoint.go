@@ -0,0 +1,127 @@
+package index
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// checkpointer tracks how far an indexing walk has got, recording it as the
+// run's store.Run.Checkpoint so the run can be resumed (see Options.Resume).
+//
+// Entries are numbered in walk order as they are visited, and are settled once
+// their row has been written, or straight away if they need none. Because
+// files are hashed concurrently, entries settle out of order. A directory is
+// complete once the walk has left it and every entry up to its last
+// descendant has settled; the last complete directory is the checkpoint.
+type checkpointer struct {
+	run   int64
+	batch *store.Batch
+
+	mu      sync.Mutex
+	next    int64              // the number of the next entry visited
+	settled int64              // every entry numbered below settled has settled
+	pending map[int64]struct{} // visited entries that have not settled
+	open    []string           // the directories the walk is in, outermost first
+	left    []walkedDir        // directories the walk has left, not yet complete
+}
+
+// walkedDir is a directory the walk has left: end is the number of the first
+// entry visited after it.
+type walkedDir struct {
+	path string
+	end  int64
+}
+
+func newCheckpointer(run int64, b *store.Batch) *checkpointer {
+	return &checkpointer{run: run, batch: b, pending: make(map[int64]struct{})}
+}
+
+// visit numbers the next entry walked, path, and returns its number. Every
+// directory the walk has now left is queued to become the checkpoint. The
+// entry must later be settled. A nil checkpointer tracks nothing.
+func (c *checkpointer) visit(path string, dir bool) int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.next
+	c.next++
+	c.pending[n] = struct{}{}
+	for len(c.open) > 0 && !within(path, c.open[len(c.open)-1]) {
+		c.left = append(c.left, walkedDir{c.open[len(c.open)-1], n})
+		c.open = c.open[:len(c.open)-1]
+	}
+	if dir {
+		c.open = append(c.open, path)
+	}
+	c.advance()
+	return n
+}
+
+// settle records that entry n has been dealt with.
+func (c *checkpointer) settle(n int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, n)
+	c.advance()
+}
+
+// walked records that the walk finished, leaving every directory.
+func (c *checkpointer) walked() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.open) - 1; i >= 0; i-- {
+		c.left = append(c.left, walkedDir{c.open[i], c.next})
+	}
+	c.open = nil
+	c.advance()
+}
+
+// advance moves settled past the entries that have settled, and records the
+// last directory that is now complete. Callers must hold c.mu.
+func (c *checkpointer) advance() {
+	for c.settled < c.next {
+		if _, ok := c.pending[c.settled]; ok {
+			break
+		}
+		c.settled++
+	}
+	last := ""
+	for len(c.left) > 0 && c.left[0].end <= c.settled {
+		last = c.left[0].path
+		c.left = c.left[1:]
+	}
+	if last != "" {
+		c.batch.Checkpoint(c.run, last)
+	}
+}
+
+// indexedBefore reports whether a walk resumed from checkpoint (see
+// store.Run.Checkpoint) has already indexed path: whether path lies below
+// checkpoint or comes before it in walk order.
+func indexedBefore(path, checkpoint string) bool {
+	return within(path, checkpoint) || walkKey(path) < walkKey(checkpoint)
+}
+
+// walkKey returns a string that sorts like path does in walk order.
+// filepath.Walk visits the entries of a directory in lexical order, each
+// followed by everything below it, which is the order of the paths' names
+// compared one by one. Replacing the separators with the lowest byte, which no
+// name contains, gives that order to a plain comparison: "a/b" sorts before
+// "a-b", as Walk visits it.
+func walkKey(path string) string {
+	return strings.ReplaceAll(path, string(filepath.Separator), "\x00")
+}
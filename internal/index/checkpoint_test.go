@@ -0,0 +1,147 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+func TestWalkKeyOrder(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", filepath.Join("a", "b"), "a b"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", dir, err)
+		}
+	}
+	for _, name := range []string{"a-b", "a.b", filepath.Join("a", "b", "c"), filepath.Join("a", "b-c"), filepath.Join("a b", "c")} {
+		writeFile(t, root, name, "x")
+	}
+
+	var walked []string
+	if err := filepath.Walk(root, func(path string, _ fs.FileInfo, err error) error {
+		walked = append(walked, path)
+		return err
+	}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	for i := 1; i < len(walked); i++ {
+		if walkKey(walked[i-1]) >= walkKey(walked[i]) {
+			t.Fatalf("walkKey sorts %q after %q, which Walk visits first", walked[i-1], walked[i])
+		}
+	}
+
+	checkpoint := filepath.Join(root, "a")
+	for path, want := range map[string]bool{
+		root:                               true,
+		checkpoint:                         true,
+		filepath.Join(root, "a", "b", "c"): true,
+		filepath.Join(root, "a b"):         false,
+		filepath.Join(root, "a-b"):         false,
+		filepath.Join(root, "a b", "c"):    false,
+	} {
+		if got := indexedBefore(path, checkpoint); got != want {
+			t.Errorf("indexedBefore(%q, %q) = %v, want %v", path, checkpoint, got, want)
+		}
+	}
+}
+
+// stopHasher hashes like xxh3, calling cancel as it starts on file number
+// stop, so a run can be interrupted part-way. Runs using it need one worker.
+type stopHasher struct {
+	stop   int
+	hashed int
+	cancel context.CancelFunc
+}
+
+func (h *stopHasher) Name() string { return "stop-test" }
+
+func (h *stopHasher) Hash(r io.Reader) (string, error) {
+	if h.hashed++; h.hashed == h.stop {
+		h.cancel()
+	}
+	return xxh3Hasher{}.Hash(r)
+}
+
+// buildDirs creates dirs a, b, c and d holding files 1, 2 and 3 each, all with
+// different content.
+func buildDirs(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b", "c", "d"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", dir, err)
+		}
+		for _, name := range []string{"1", "2", "3"} {
+			writeFile(t, filepath.Join(root, dir), name, strings.Repeat(dir+name, 10))
+		}
+	}
+	return root
+}
+
+func TestRunResume(t *testing.T) {
+	s := openStore(t)
+	root := buildDirs(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	h := &stopHasher{stop: 5, cancel: cancel}
+	Register(h)
+	opts := Options{Hash: true, Rehash: true, HashAlgo: h.Name(), Workers: 1, Resume: true}
+
+	// The fifth file, b/2, is abandoned: a is the last complete directory.
+	if _, err := Run(ctx, s, root, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted Run = %v, want context.Canceled", err)
+	}
+	runs, err := s.Runs("")
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Runs = %+v, %v", runs, err)
+	}
+	first := runs[0]
+	if want := filepath.Join(root, "a"); first.Checkpoint != want {
+		t.Fatalf("checkpoint = %q, want %q", first.Checkpoint, want)
+	}
+
+	h.stop = 0
+	if _, err := Run(t.Context(), s, root, opts); err != nil {
+		t.Fatalf("resumed Run: %v", err)
+	}
+	if runs, err = s.Runs(""); err != nil {
+		t.Fatalf("Runs: %v", err)
+	}
+	// Only the files after a were hashed again, b/1 among them.
+	resumed := runs[0]
+	if resumed.Resumed != first.ID || resumed.Status != store.RunDone || resumed.Hashed != 9 || resumed.Checkpoint != root {
+		t.Fatalf("resumed run = %+v", resumed)
+	}
+
+	// The rows are those of a run that was never interrupted.
+	whole := openStore(t)
+	if _, err := Run(t.Context(), whole, root, Options{Hash: true, HashAlgo: h.Name()}); err != nil {
+		t.Fatalf("uninterrupted Run: %v", err)
+	}
+	paths, err := whole.Paths(root)
+	if err != nil {
+		t.Fatalf("Paths: %v", err)
+	}
+	if got, err := s.Paths(root); err != nil || len(got) != len(paths) {
+		t.Fatalf("resumed index has %d rows, want %d (%v)", len(got), len(paths), err)
+	}
+	for _, path := range paths {
+		if got, want := lookup(t, s, path), lookup(t, whole, path); !got.Equal(want) || got.Hash != want.Hash {
+			t.Fatalf("resumed row %+v, want %+v", got, want)
+		}
+	}
+
+	// A finished run is not resumed.
+	if _, err := Run(t.Context(), s, root, opts); err != nil {
+		t.Fatalf("third Run: %v", err)
+	}
+	if runs, err = s.Runs(""); err != nil || runs[0].Resumed != 0 || runs[0].Hashed != 12 {
+		t.Fatalf("run after a finished one = %+v, %v", runs[0], err)
+	}
+}
@@ -0,0 +1,153 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// HashCollisions fills in the hashes needed for duplicate detection among this
+// host's indexed files, reading as little as possible: a file with a unique
+// size cannot have a duplicate, so only files whose size collides get an
+// imohash, and only files whose size and imohash both collide get the full
+// digest of opts.HashAlgo. Files already carrying the hash a stage needs are
+// not read again. Only opts.HashAlgo, Workers, BatchSize and BatchInterval
+// are used.
+//
+// Files are checked against their rows before hashing; one that changed since
+// it was indexed is left for the next indexing run. If ctx is cancelled no
+// more files are hashed, and the hashes computed so far are written.
+func HashCollisions(ctx context.Context, s *store.Store, opts Options) error {
+	return hashCollisions(ctx, s, opts, new(counts))
+}
+
+// hashCollisions implements HashCollisions, tallying its work in c.
+func hashCollisions(ctx context.Context, s *store.Store, opts Options, c *counts) error {
+	full, err := LookupHasher(opts.HashAlgo)
+	if err != nil {
+		return err
+	}
+	opts.Quick = false
+
+	need, err := imohashCandidates(s)
+	if err != nil {
+		return err
+	}
+	if err := hashRows(ctx, s, need, opts, true, nil, c); err != nil {
+		return fmt.Errorf("imohash size collisions: %w", err)
+	}
+
+	if need, err = digestCandidates(s, full.Name()); err != nil {
+		return err
+	}
+	if err := hashRows(ctx, s, need, opts, false, full, c); err != nil {
+		return fmt.Errorf("%s imohash collisions: %w", full.Name(), err)
+	}
+	return nil
+}
+
+// NeedsHashing reports whether HashCollisions with opts has files to hash,
+// i.e. whether Duplicates could be missing groups. It only reads the store, so
+// it works on a read-only one.
+func NeedsHashing(s *store.Store, opts Options) (bool, error) {
+	full, err := LookupHasher(opts.HashAlgo)
+	if err != nil {
+		return false, err
+	}
+	need, err := imohashCandidates(s)
+	if err != nil || len(need) > 0 {
+		return len(need) > 0, err
+	}
+	need, err = digestCandidates(s, full.Name())
+	return len(need) > 0, err
+}
+
+// imohashCandidates returns the files whose size collides but that have no
+// imohash yet.
+func imohashCandidates(s *store.Store) ([]store.FileInfo, error) {
+	var need []store.FileInfo
+	for group, err := range s.SizeCollisions() {
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range group {
+			if fi.Imohash == "" {
+				need = append(need, fi)
+			}
+		}
+	}
+	return need, nil
+}
+
+// digestCandidates returns the files whose size and imohash collide but that
+// have no digest from algo yet.
+func digestCandidates(s *store.Store, algo string) ([]store.FileInfo, error) {
+	var need []store.FileInfo
+	for group, err := range s.SizeCollisions() {
+		if err != nil {
+			return nil, err
+		}
+		byImo := make(map[string][]store.FileInfo)
+		for _, fi := range group {
+			if fi.Imohash != "" {
+				byImo[fi.Imohash] = append(byImo[fi.Imohash], fi)
+			}
+		}
+		for _, same := range byImo {
+			if len(same) < 2 {
+				continue
+			}
+			for _, fi := range same {
+				if fi.Hash == "" || fi.HashAlgo != algo {
+					need = append(need, fi)
+				}
+			}
+		}
+	}
+	return need, nil
+}
+
+// hashRows computes the imohash (if wantImo) and the full digest (if full is
+// not nil) of each row's file and writes them back to its row. A row of
+// unknown type, from before types were recorded, is checked first: if it is
+// not a regular file it is not opened, and only its type is written back.
+func hashRows(ctx context.Context, s *store.Store, rows []store.FileInfo, opts Options, wantImo bool, full Hasher, c *counts) error {
+	p := newPipeline(ctx, s, opts, c, 0)
+	for _, fi := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		if fi.Type == "" {
+			if info, err := os.Lstat(fi.Path); err == nil && !info.Mode().IsRegular() {
+				fi.Type, fi.Mode = store.TypeOf(info.Mode()), info.Mode()
+				p.put(fi, 0)
+				continue
+			}
+		}
+		p.hash(fi, 0, func(fi *store.FileInfo) error {
+			imo, digest, info, err := hashPath(ctx, fi.Path, wantImo, full, p.lim)
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("%q is no longer a regular file", fi.Path)
+			}
+			if info.Size() != fi.Size || !info.ModTime().Equal(fi.ModTime) {
+				return fmt.Errorf("%q changed since it was indexed", fi.Path)
+			}
+			if wantImo {
+				fi.Imohash = imo
+			}
+			if full != nil {
+				fi.Hash, fi.HashAlgo = digest, full.Name()
+			}
+			return nil
+		})
+	}
+	if err := p.close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
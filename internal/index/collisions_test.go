@@ -0,0 +1,213 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"modernc.org/ql"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// buildCollisionTree creates a.txt and b.txt (identical), c.txt (same size,
+// different content) and d.txt (a size of its own).
+func buildCollisionTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeFile(t, root, "a.txt", "same!")
+	writeFile(t, root, "b.txt", "same!")
+	writeFile(t, root, "c.txt", "diff!")
+	writeFile(t, root, "d.txt", "unique size")
+	return root
+}
+
+func lookup(t *testing.T, s *store.Store, path string) store.FileInfo {
+	t.Helper()
+	fi, ok, err := s.Lookup(path)
+	if err != nil || !ok {
+		t.Fatalf("Lookup %s: %v %v", path, ok, err)
+	}
+	return fi
+}
+
+func TestRunSizeFirst(t *testing.T) {
+	s := openStore(t)
+	root := buildCollisionTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, SizeFirst: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if fi := lookup(t, s, filepath.Join(root, name)); fi.Imohash == "" || fi.Hash == "" {
+			t.Errorf("%s: want both hashes, got %+v", name, fi)
+		}
+	}
+	if fi := lookup(t, s, filepath.Join(root, "c.txt")); fi.Imohash == "" || fi.Hash != "" {
+		t.Errorf("c.txt: want only an imohash, got %+v", fi)
+	}
+	if fi := lookup(t, s, filepath.Join(root, "d.txt")); fi.Imohash != "" || fi.Hash != "" {
+		t.Errorf("d.txt: unique size was hashed: %+v", fi)
+	}
+
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Copies) != 2 {
+		t.Fatalf("got dup groups %+v, want a.txt and b.txt", groups)
+	}
+}
+
+func TestRunSizeFirstKeepsHashes(t *testing.T) {
+	s := openStore(t)
+	root := buildCollisionTree(t)
+	a := filepath.Join(root, "a.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, SizeFirst: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	tamper(t, s, a)
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, SizeFirst: true}); err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+	if fi := lookup(t, s, a); fi.Hash != "stale" {
+		t.Fatalf("unchanged candidate was hashed again: %+v", fi)
+	}
+
+	// A new file that collides with d.txt's size makes d.txt a candidate.
+	writeFile(t, root, "e.txt", "unique sizE")
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, SizeFirst: true}); err != nil {
+		t.Fatalf("Run with e.txt: %v", err)
+	}
+	if fi := lookup(t, s, filepath.Join(root, "d.txt")); fi.Imohash == "" {
+		t.Fatal("d.txt not hashed once its size collided")
+	}
+}
+
+func TestHashCollisionsSkipsChangedFiles(t *testing.T) {
+	s := openStore(t)
+	root := buildCollisionTree(t)
+	a := filepath.Join(root, "a.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(a, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := HashCollisions(t.Context(), s, Options{}); err != nil {
+		t.Fatalf("HashCollisions: %v", err)
+	}
+	if fi := lookup(t, s, a); fi.Imohash != "" {
+		t.Fatalf("file changed since indexing was hashed against its old row: %+v", fi)
+	}
+	if fi := lookup(t, s, filepath.Join(root, "b.txt")); fi.Imohash == "" {
+		t.Fatal("unchanged candidate b.txt was not hashed")
+	}
+}
+
+func TestNeedsHashingAfterNoHashIndex(t *testing.T) {
+	s := openStore(t)
+	root := buildCollisionTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if need, err := NeedsHashing(s, Options{}); err != nil || !need {
+		t.Fatalf("NeedsHashing after a -no-hash index = %v, %v; want true", need, err)
+	}
+	if groups, _ := s.Duplicates(""); len(groups) != 0 {
+		t.Fatalf("unhashed index reported duplicates: %+v", groups)
+	}
+
+	if err := HashCollisions(t.Context(), s, Options{}); err != nil {
+		t.Fatalf("HashCollisions: %v", err)
+	}
+	if need, err := NeedsHashing(s, Options{}); err != nil || need {
+		t.Fatalf("NeedsHashing after HashCollisions = %v, %v; want false", need, err)
+	}
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Copies) != 2 {
+		t.Fatalf("got dup groups %+v, want a.txt and b.txt", groups)
+	}
+}
+
+// TestHashCollisionsLegacyRows runs -dupes's lazy hashing against a database
+// written before file types were recorded: its -no-hash rows have no type, yet
+// the regular files among them must still be hashed and grouped, while a
+// directory of the same size is recognised and never read.
+func TestHashCollisionsLegacyRows(t *testing.T) {
+	root := buildCollisionTree(t)
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	dir := t.TempDir()
+	db, err := ql.OpenFile(filepath.Join(dir, "files.db"), &ql.Options{CanCreate: true, FileFormat: 2})
+	if err != nil {
+		t.Fatalf("create fixture: %v", err)
+	}
+	if _, _, err := db.Run(ql.NewRWCtx(), `
+		BEGIN TRANSACTION;
+			CREATE TABLE files (
+				hostname string,
+				filename string,
+				size int64,
+				modtimestamp time,
+				imohash string,
+				xxh3hash string,
+			);
+		COMMIT;`); err != nil {
+		t.Fatalf("create fixture table: %v", err)
+	}
+	for _, path := range []string{filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt"), sub} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		// The directory gets the files' size, so it joins their group.
+		if _, _, err := db.Run(ql.NewRWCtx(), `
+			BEGIN TRANSACTION;
+				INSERT INTO files VALUES("testhost", $1, 5, $2, "", "");
+			COMMIT;`, path, info.ModTime()); err != nil {
+			t.Fatalf("populate fixture: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close fixture: %v", err)
+	}
+
+	s, err := store.Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("store.Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	if need, err := NeedsHashing(s, Options{}); err != nil || !need {
+		t.Fatalf("NeedsHashing on legacy rows = %v, %v; want true", need, err)
+	}
+	if err := HashCollisions(t.Context(), s, Options{}); err != nil {
+		t.Fatalf("HashCollisions: %v", err)
+	}
+	if need, err := NeedsHashing(s, Options{}); err != nil || need {
+		t.Fatalf("NeedsHashing after HashCollisions = %v, %v; want false", need, err)
+	}
+	if fi := lookup(t, s, sub); fi.Type != store.TypeDir || fi.Imohash != "" {
+		t.Fatalf("legacy directory row = %+v, want its type recorded and no hash", fi)
+	}
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Copies) != 2 {
+		t.Fatalf("got dup groups %+v, want a.txt and b.txt", groups)
+	}
+}
@@ -0,0 +1,146 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cacheDirSignature starts every valid CACHEDIR.TAG file
+// (https://bford.info/cachedir/). Directories holding one contain regenerable
+// caches and are never indexed.
+const cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// filter decides which walked entries are left out of the index. It is used
+// only from the walk goroutine.
+type filter struct {
+	root        string
+	exclude     []string
+	excludeRe   []*regexp.Regexp
+	pruneNames  map[string]struct{}
+	prunePaths  map[string]struct{}
+	pruneMounts map[string]struct{} // mount points of pruned filesystems
+	device      uint64              // root's device, with Options.OneFilesystem
+	ignores     ignoreStack
+}
+
+// newFilter builds the filter for a walk of root, rejecting malformed globs
+// up front rather than silently matching nothing.
+func newFilter(root string, opts Options) (*filter, error) {
+	f := &filter{
+		root:       root,
+		exclude:    opts.Exclude,
+		excludeRe:  opts.ExcludeRegexp,
+		pruneNames: make(map[string]struct{}, len(opts.PruneNames)),
+		prunePaths: make(map[string]struct{}, len(opts.PrunePaths)),
+	}
+	for _, pattern := range opts.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("exclude pattern %q: %w", pattern, err)
+		}
+	}
+	for _, name := range opts.PruneNames {
+		f.pruneNames[name] = struct{}{}
+	}
+	for _, p := range opts.PrunePaths {
+		f.prunePaths[filepath.Clean(p)] = struct{}{}
+	}
+
+	mountInfo := opts.MountInfo
+	if mountInfo == "" {
+		mountInfo = DefaultMountInfo
+	}
+	var err error
+	if f.pruneMounts, err = prunedMounts(mountInfo, opts.PruneFS, opts.PruneBindMounts); err != nil {
+		return nil, fmt.Errorf("read mount table: %w", err)
+	}
+	if opts.OneFilesystem {
+		// A root that cannot be stat'd fails the walk anyway.
+		if info, err := os.Lstat(root); err == nil {
+			f.device = device(info)
+		}
+	}
+	return f, nil
+}
+
+// skip reports whether the walk should leave path out of the index. For a
+// directory that means not descending into it either. The root itself is
+// never skipped: it was asked for explicitly.
+func (f *filter) skip(path string, info fs.FileInfo) bool {
+	isDir := info.IsDir()
+	if path != f.root && f.excluded(path, info) {
+		return true
+	}
+	if !isDir {
+		return false
+	}
+	if path != f.root && isCacheDir(path) {
+		return true
+	}
+	l, err := loadIgnore(path)
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("ignoring unreadable ignore file")
+	}
+	if l != nil {
+		f.ignores.push(l)
+	}
+	return false
+}
+
+// excluded applies the configured rules and any enclosing ignore files.
+func (f *filter) excluded(path string, info fs.FileInfo) bool {
+	isDir := info.IsDir()
+	name := filepath.Base(path)
+	if isDir {
+		if _, ok := f.pruneNames[name]; ok {
+			return true
+		}
+		if _, ok := f.prunePaths[path]; ok {
+			return true
+		}
+		if _, ok := f.pruneMounts[path]; ok {
+			return true
+		}
+		if f.device != 0 && device(info) != f.device {
+			return true
+		}
+	}
+	for _, pattern := range f.exclude {
+		// A pattern naming a directory is matched against the whole path;
+		// otherwise against the base name, at any depth.
+		subject := name
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			subject = path
+		}
+		if ok, _ := filepath.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	for _, re := range f.excludeRe {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return f.ignores.ignored(path, isDir)
+}
+
+// isCacheDir reports whether dir holds a CACHEDIR.TAG with a valid signature.
+func isCacheDir(dir string) bool {
+	fh, err := os.Open(filepath.Join(dir, "CACHEDIR.TAG"))
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	buf := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(fh, buf); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, []byte(cacheDirSignature))
+}
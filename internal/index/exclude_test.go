@@ -0,0 +1,144 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// indexed returns the paths under root recorded in s, relative to root.
+func indexed(t *testing.T, s *store.Store, root string) []string {
+	t.Helper()
+	paths, err := s.Paths(root)
+	if err != nil {
+		t.Fatalf("Paths: %v", err)
+	}
+	var rel []string
+	for _, p := range paths {
+		r, err := filepath.Rel(root, p)
+		if err != nil {
+			t.Fatalf("Rel: %v", err)
+		}
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	sort.Strings(rel)
+	return rel
+}
+
+// buildExcludeTree creates a tree exercising every kind of exclusion.
+func buildExcludeTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{".git", "node_modules/pkg", "cache", "src/gen", "logs"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", dir, err)
+		}
+	}
+	writeFile(t, root, "main.go", "package main")
+	writeFile(t, root, "notes.bak", "old")
+	writeFile(t, filepath.Join(root, ".git"), "HEAD", "ref")
+	writeFile(t, filepath.Join(root, "node_modules", "pkg"), "index.js", "js")
+	writeFile(t, filepath.Join(root, "cache"), "CACHEDIR.TAG", cacheDirSignature+"\n# created by a test\n")
+	writeFile(t, filepath.Join(root, "cache"), "blob", "cached")
+	writeFile(t, filepath.Join(root, "src"), "a.go", "package src")
+	writeFile(t, filepath.Join(root, "src", "gen"), "b.go", "package gen")
+	writeFile(t, filepath.Join(root, "logs"), "x.log", "log")
+	writeFile(t, filepath.Join(root, "logs"), "keep.log", "log")
+	writeFile(t, root, IgnoreFile, "*.log\nsrc/gen/\n")
+	writeFile(t, filepath.Join(root, "logs"), IgnoreFile, "!keep.log\n")
+	return root
+}
+
+func TestRunExclusions(t *testing.T) {
+	s := openStore(t)
+	root := buildExcludeTree(t)
+
+	opts := Options{
+		Exclude:       []string{"*.bak"},
+		ExcludeRegexp: []*regexp.Regexp{regexp.MustCompile(`/node_modules$`)},
+		PruneNames:    []string{".git"},
+	}
+	if _, err := Run(t.Context(), s, root, opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	want := []string{".", IgnoreFile, "logs", "logs/" + IgnoreFile, "logs/keep.log", "main.go", "src", "src/a.go"}
+	got := indexed(t, s, root)
+	if len(got) != len(want) {
+		t.Fatalf("indexed %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("indexed %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRunPrunesNewlyExcludedRows(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, err := Run(t.Context(), s, root, Options{PrunePaths: []string{filepath.Join(root, "sub")}}); err != nil {
+		t.Fatalf("Run excluding sub: %v", err)
+	}
+	for _, p := range indexed(t, s, root) {
+		if p == "sub" || p == "sub/f3.txt" {
+			t.Fatalf("excluded row %q was kept", p)
+		}
+	}
+}
+
+func TestPruneAppliesExclusions(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := Prune(t.Context(), s, root, Options{Exclude: []string{"f1.txt"}}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	for _, p := range indexed(t, s, root) {
+		if p == "f1.txt" {
+			t.Fatal("excluded f1.txt survived -prune")
+		}
+	}
+}
+
+func TestExcludedDirectoryIsNotRead(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks do not apply to root")
+	}
+	root := buildTree(t)
+	sub := filepath.Join(root, "sub")
+	if err := os.Chmod(sub, 0o000); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(sub, 0o755) })
+
+	f, err := newFilter(root, Options{PruneNames: []string{"sub"}})
+	if err != nil {
+		t.Fatalf("newFilter: %v", err)
+	}
+	w := newWalkState()
+	if err := walk(t.Context(), root, f, w, func(string, os.FileInfo) {}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if len(w.failed) != 0 {
+		t.Fatalf("walk tried to read excluded directories: %q", w.failed)
+	}
+}
+
+func TestRunRejectsBadExcludePattern(t *testing.T) {
+	s := openStore(t)
+	if _, err := Run(t.Context(), s, t.TempDir(), Options{Exclude: []string{"[x"}}); err == nil {
+		t.Fatal("Run accepted a malformed -exclude glob")
+	}
+}
@@ -1,27 +1,29 @@
 package index
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 
 	"github.com/kalafut/imohash"
-	"github.com/zeebo/xxh3"
 )
 
-// hashFile returns the imohash and xxh3 hashes of path without reading the
-// whole file into memory. imohash only samples a fixed number of bytes from
-// the file (see imohash.SampleSize/SampleThreshold) and xxh3 is computed by
-// streaming the file in chunks, so peak memory stays bounded regardless of
-// file size. Zero-byte files are skipped (both hashes empty, nil error) since
-// there is nothing to distinguish them by content.
-//
-// The hashes are byte-identical to the previous os.ReadFile-based
-// implementation, so existing database rows remain valid.
-func hashFile(path string) (imo, xxh string, err error) {
+// hashPath computes the imohash of path if wantImo is set and the digest of
+// full if it is not nil, without reading the whole file into memory: imohash
+// only samples a fixed number of bytes from the file (see
+// imohash.SampleSize/SampleThreshold) and the digest is computed by streaming
+// the file in chunks. Zero-byte files are skipped (both hashes empty) since
+// there is nothing to distinguish them by content. It also returns the file's
+// stat taken from the open handle, so callers can check the hashes belong to
+// the version of the file they expect. Cancelling ctx abandons the digest
+// part-way through the file, with ctx's error. The digest reads are paced by
+// lim, which may be nil; imohash's few samples are not.
+func hashPath(ctx context.Context, path string, wantImo bool, full Hasher, lim *rateLimiter) (imo, digest string, info fs.FileInfo, err error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return "", "", fmt.Errorf("open %q: %w", path, err)
+		return "", "", nil, fmt.Errorf("open %q: %w", path, err)
 	}
 	defer func() {
 		if cerr := f.Close(); cerr != nil && err == nil {
@@ -29,33 +31,56 @@ func hashFile(path string) (imo, xxh string, err error) {
 		}
 	}()
 
-	fi, err := f.Stat()
+	info, err = f.Stat()
 	if err != nil {
-		return "", "", fmt.Errorf("stat %q: %w", path, err)
+		return "", "", nil, fmt.Errorf("stat %q: %w", path, err)
 	}
-	if fi.Size() == 0 {
-		return "", "", nil
+	if info.Size() == 0 {
+		return "", "", info, nil
 	}
 
-	sr := io.NewSectionReader(f, 0, fi.Size())
+	sr := io.NewSectionReader(f, 0, info.Size())
 
-	// imohash reads only its fixed samples from the section reader. Note that
-	// this leaves sr positioned somewhere in the file (the end for small files,
-	// the tail sample for large ones), so we must rewind before the next pass.
-	imoSum, err := imohash.SumSectionReader(sr)
-	if err != nil {
-		return "", "", fmt.Errorf("imohash %q: %w", path, err)
+	if wantImo {
+		// imohash reads only its fixed samples from the section reader.
+		imoSum, err := imohash.SumSectionReader(sr)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("imohash %q: %w", path, err)
+		}
+		imo = fmt.Sprintf("%x", imoSum)
 	}
 
-	// Rewind to the start and stream xxh3 over the full file so the contents
-	// are never held in memory at once.
-	if _, err := sr.Seek(0, io.SeekStart); err != nil {
-		return "", "", fmt.Errorf("seek %q: %w", path, err)
-	}
-	h := xxh3.New()
-	if _, err := io.Copy(h, sr); err != nil {
-		return "", "", fmt.Errorf("xxh3 %q: %w", path, err)
+	if full != nil {
+		// imohash leaves sr positioned somewhere in the file (the end for
+		// small files, the tail sample for large ones), so rewind, then stream
+		// the full file through the hasher so the contents are never held in
+		// memory at once.
+		if _, err := sr.Seek(0, io.SeekStart); err != nil {
+			return "", "", nil, fmt.Errorf("seek %q: %w", path, err)
+		}
+		if digest, err = full.Hash(ctxReader{ctx, sr, lim}); err != nil {
+			return "", "", nil, fmt.Errorf("%s %q: %w", full.Name(), path, err)
+		}
 	}
 
-	return fmt.Sprintf("%x", imoSum), fmt.Sprintf("%x", h.Sum64()), nil
+	return imo, digest, info, nil
+}
+
+// ctxReader fails reads with ctx's error once ctx is cancelled, so a long
+// read can be abandoned between chunks, and waits on lim after each chunk.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rateLimiter
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if werr := r.lim.wait(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
 }
@@ -1,6 +1,8 @@
 package index
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -19,6 +21,13 @@ func writeFile(t *testing.T, dir, name, content string) string {
 	return path
 }
 
+// hashFile returns the imohash and xxh3 digest of path, as indexing with the
+// default hasher records them.
+func hashFile(path string) (imo, xxh string, err error) {
+	imo, xxh, _, err = hashPath(context.Background(), path, true, xxh3Hasher{}, nil)
+	return imo, xxh, err
+}
+
 func TestHashFileDeterministicAndMatching(t *testing.T) {
 	dir := t.TempDir()
 	a := writeFile(t, dir, "a", "hello world")
@@ -107,3 +116,12 @@ func randomBytes(n int) []byte {
 	}
 	return b
 }
+
+func TestHashPathCancelled(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "f", "some content")
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, _, _, err := hashPath(ctx, path, false, xxh3Hasher{}, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("hashPath with a cancelled context = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,136 @@
+package index
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+// DefaultHashAlgo is the full-content hash used when Options.HashAlgo is
+// empty. xxh3 is not cryptographic but is fast, and collision-free enough to
+// identify duplicates.
+const DefaultHashAlgo = "xxh3"
+
+// Hasher computes the full-content digest of a file. The digest is stored
+// with the Hasher's name, so digests of different algorithms are never
+// compared.
+type Hasher interface {
+	// Name is the algorithm's name in the registry and in the store.
+	Name() string
+	// Hash returns the digest of everything read from r, as a string.
+	Hash(r io.Reader) (string, error)
+}
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = make(map[string]Hasher)
+)
+
+func init() {
+	Register(xxh3Hasher{})
+	Register(NewHasher("sha256", sha256.New))
+	Register(NewHasher("blake3", func() hash.Hash { return blake3.New() }))
+	Register(NewHasher("md5", md5.New))
+	Register(NewHasher("crc32", func() hash.Hash { return crc32.NewIEEE() }))
+}
+
+// weakAlgos names the registered digests that two different files can share:
+// crc32 by accident, being 32 bits, and md5 by design, as colliding files are
+// easy to make. They still serve for manifests and scrubbing, but not to
+// decide that files are duplicates.
+var weakAlgos = map[string]bool{"crc32": true, "md5": true}
+
+// CheckDupAlgo returns an error if digests of the algorithm called name
+// cannot be trusted to show that two files have the same content, so that
+// duplicates should not be reported, let alone linked together, by them.
+func CheckDupAlgo(name string) error {
+	if weakAlgos[name] {
+		return fmt.Errorf("%s digests can be shared by different files, so they cannot identify duplicates", name)
+	}
+	return nil
+}
+
+// Register makes h available by name, replacing any Hasher of the same name.
+func Register(h Hasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	hashers[h.Name()] = h
+}
+
+// LookupHasher returns the registered Hasher called name, or DefaultHashAlgo's
+// if name is empty.
+func LookupHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = DefaultHashAlgo
+	}
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q (have %s)", name, strings.Join(hasherNames(), ", "))
+	}
+	return h, nil
+}
+
+// HashAlgos returns the names of the registered Hashers, sorted.
+func HashAlgos() []string {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	return hasherNames()
+}
+
+// hasherNames returns the sorted registry names. Callers must hold hashersMu.
+func hasherNames() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// NewHasher returns a Hasher called name that streams its input through a
+// hash.Hash from newHash and hex-encodes the sum, the format of sha256sum,
+// md5sum and similar tools.
+func NewHasher(name string, newHash func() hash.Hash) Hasher {
+	return stdHasher{name, newHash}
+}
+
+type stdHasher struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+func (h stdHasher) Name() string { return h.name }
+
+func (h stdHasher) Hash(r io.Reader) (string, error) {
+	hh := h.newHash()
+	if _, err := io.Copy(hh, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hh.Sum(nil)), nil
+}
+
+// xxh3Hasher is the original gocate digest: the 64-bit xxh3 sum in hex
+// without zero padding. Its format is kept so existing rows stay comparable.
+type xxh3Hasher struct{}
+
+func (xxh3Hasher) Name() string { return "xxh3" }
+
+func (xxh3Hasher) Hash(r io.Reader) (string, error) {
+	h := xxh3.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
@@ -0,0 +1,94 @@
+package index
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashers(t *testing.T) {
+	want := map[string]string{
+		"sha256": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"md5":    "900150983cd24fb0d6963f7d28e17f72",
+		"crc32":  "352441c2",
+		"blake3": "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+	}
+	for name, digest := range want {
+		h, err := LookupHasher(name)
+		if err != nil {
+			t.Fatalf("LookupHasher(%q): %v", name, err)
+		}
+		got, err := h.Hash(strings.NewReader("abc"))
+		if err != nil || got != digest {
+			t.Errorf("%s(abc) = %q, %v; want %q", name, got, err, digest)
+		}
+	}
+}
+
+func TestDefaultHasherMatchesHashFile(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "f", "hello world")
+	_, xxh, err := hashFile(path)
+	if err != nil {
+		t.Fatalf("hashFile: %v", err)
+	}
+	h, err := LookupHasher("")
+	if err != nil {
+		t.Fatalf("LookupHasher: %v", err)
+	}
+	got, err := h.Hash(strings.NewReader("hello world"))
+	if err != nil || got != xxh || h.Name() != DefaultHashAlgo {
+		t.Fatalf("default hasher %s = %q, %v; want hashFile's %q", h.Name(), got, err, xxh)
+	}
+}
+
+func TestLookupHasherUnknown(t *testing.T) {
+	_, err := LookupHasher("rot13")
+	if err == nil || !strings.Contains(err.Error(), "sha256") {
+		t.Fatalf("LookupHasher(rot13) = %v, want an error listing the algorithms", err)
+	}
+	if _, err := Run(t.Context(), openStore(t), t.TempDir(), Options{Hash: true, HashAlgo: "rot13"}); err == nil {
+		t.Fatal("Run accepted an unknown hash algorithm")
+	}
+}
+
+func TestCheckDupAlgo(t *testing.T) {
+	for _, name := range []string{"xxh3", "sha256", "blake3"} {
+		if err := CheckDupAlgo(name); err != nil {
+			t.Errorf("CheckDupAlgo(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{"crc32", "md5"} {
+		if err := CheckDupAlgo(name); err == nil {
+			t.Errorf("CheckDupAlgo(%q) accepted a weak digest", name)
+		}
+	}
+}
+
+func TestRunSwitchesHashAlgo(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if fi := lookup(t, s, f1); fi.HashAlgo != "xxh3" {
+		t.Fatalf("default run recorded %q digests", fi.HashAlgo)
+	}
+
+	// Unchanged files are hashed again when the algorithm changes.
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, HashAlgo: "sha256"}); err != nil {
+		t.Fatalf("Run sha256: %v", err)
+	}
+	fi := lookup(t, s, f1)
+	if fi.HashAlgo != "sha256" || len(fi.Hash) != 64 {
+		t.Fatalf("f1 after a sha256 run = %+v", fi)
+	}
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Algo != "sha256" {
+		t.Fatalf("Duplicates = %+v, want one sha256 group", groups)
+	}
+}
@@ -0,0 +1,153 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFile is the name of the per-directory file listing paths to leave out
+// of the index, in the same syntax as .gitignore.
+const IgnoreFile = ".gocateignore"
+
+// ignoreRule is one pattern line of an ignore file.
+type ignoreRule struct {
+	segs    []string // pattern split on "/", matched segment by segment
+	negate  bool     // "!pattern": re-include what an earlier rule excluded
+	dirOnly bool     // "pattern/": only matches directories
+}
+
+// ignoreList holds the rules of one ignore file, which apply to everything
+// below dir.
+type ignoreList struct {
+	dir   string
+	rules []ignoreRule
+}
+
+// parseIgnore parses ignore file content using .gitignore semantics: blank
+// lines and "#" comments are skipped, "!" negates, a trailing "/" matches only
+// directories, a pattern containing "/" is anchored to dir while one without
+// matches a name at any depth, and "**" matches any number of directories.
+func parseIgnore(dir string, data []byte) *ignoreList {
+	l := &ignoreList{dir: dir}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		r.segs = strings.Split(line, "/")
+		l.rules = append(l.rules, r)
+	}
+	return l
+}
+
+// loadIgnore reads dir's ignore file. It returns nil if there is none.
+func loadIgnore(dir string) (*ignoreList, error) {
+	data, err := os.ReadFile(filepath.Join(dir, IgnoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", IgnoreFile, err)
+	}
+	return parseIgnore(dir, data), nil
+}
+
+// match reports whether the list decides p, a path below l.dir, and if so
+// whether it is ignored. As in git, the last matching rule wins.
+func (l *ignoreList) match(p string, isDir bool) (ignored, decided bool) {
+	rel, err := filepath.Rel(l.dir, p)
+	if err != nil {
+		return false, false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := len(l.rules) - 1; i >= 0; i-- {
+		r := l.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if matchSegs(r.segs, parts) {
+			return !r.negate, true
+		}
+	}
+	return false, false
+}
+
+// matchSegs matches path segments against pattern segments, where a "**"
+// segment stands for zero or more whole segments. A trailing "**" needs at
+// least one, so "dir/**" matches what is inside dir but not dir itself.
+func matchSegs(pat, name []string) bool {
+	if len(pat) == 0 {
+		return len(name) == 0
+	}
+	if pat[0] == "**" {
+		if len(pat) == 1 {
+			return len(name) > 0
+		}
+		for i := 0; i <= len(name); i++ {
+			if matchSegs(pat[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pat[0], name[0])
+	return ok && matchSegs(pat[1:], name[1:])
+}
+
+// ignoreStack tracks the ignore files of the directories enclosing the current
+// walk position. filepath.Walk is depth-first, so lists whose directory the
+// walk has left are popped before each lookup.
+type ignoreStack []*ignoreList
+
+// ignored reports whether p is ignored by the files of its ancestors, the
+// deepest of which takes precedence.
+func (st *ignoreStack) ignored(p string, isDir bool) bool {
+	for n := len(*st); n > 0 && !below(p, (*st)[n-1].dir); n-- {
+		*st = (*st)[:n-1]
+	}
+	for i := len(*st) - 1; i >= 0; i-- {
+		if ignored, ok := (*st)[i].match(p, isDir); ok {
+			return ignored
+		}
+	}
+	return false
+}
+
+func (st *ignoreStack) push(l *ignoreList) {
+	*st = append(*st, l)
+}
+
+// below reports whether path lies strictly below dir.
+func below(path, dir string) bool {
+	return path != dir && within(path, dir)
+}
@@ -0,0 +1,73 @@
+package index
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	dir := filepath.FromSlash("/top")
+	l := parseIgnore(dir, []byte(`# comment
+
+*.log
+!keep.log
+build/
+/only-here
+docs/*.tmp
+a/**/z
+cache/**
+\#hash
+`))
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+		decided bool
+	}{
+		{"x.log", false, true, true},
+		{"deep/down/x.log", false, true, true},
+		{"deep/keep.log", false, false, true}, // negated by the later rule
+		{"build", true, true, true},
+		{"build", false, false, false}, // trailing slash: directories only
+		{"sub/build", true, true, true},
+		{"only-here", false, true, true},
+		{"sub/only-here", false, false, false}, // anchored to the file's directory
+		{"docs/a.tmp", false, true, true},
+		{"docs/sub/a.tmp", false, false, false}, // * does not cross directories
+		{"a/z", true, true, true},
+		{"a/b/c/z", false, true, true},
+		{"cache", true, false, false}, // dir/** matches the contents only
+		{"cache/x", false, true, true},
+		{"#hash", false, true, true},
+		{"main.go", false, false, false},
+	}
+	for _, tt := range tests {
+		ignored, decided := l.match(filepath.Join(dir, filepath.FromSlash(tt.path)), tt.isDir)
+		if ignored != tt.ignored || decided != tt.decided {
+			t.Errorf("match(%q, dir=%v) = %v, %v; want %v, %v", tt.path, tt.isDir, ignored, decided, tt.ignored, tt.decided)
+		}
+	}
+}
+
+func TestIgnoreStackDeepestWins(t *testing.T) {
+	top := filepath.FromSlash("/top")
+	sub := filepath.Join(top, "sub")
+	var st ignoreStack
+	st.push(parseIgnore(top, []byte("*.dat\n")))
+	st.push(parseIgnore(sub, []byte("!wanted.dat\n")))
+
+	if !st.ignored(filepath.Join(sub, "other.dat"), false) {
+		t.Error("rule from the parent directory not applied below it")
+	}
+	if st.ignored(filepath.Join(sub, "wanted.dat"), false) {
+		t.Error("deeper ignore file did not override its parent")
+	}
+	// Leaving sub pops its list: its negation no longer applies.
+	if !st.ignored(filepath.Join(top, "wanted.dat"), false) {
+		t.Error("ignore file applied outside its directory")
+	}
+	if len(st) != 1 {
+		t.Errorf("stack has %d lists after leaving sub, want 1", len(st))
+	}
+}
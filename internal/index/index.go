@@ -4,15 +4,28 @@
 // The pipeline is a bounded producer/consumer fan-out: filepath.Walk produces
 // dirents, a worker pool hashes regular files concurrently (capped so a large
 // tree cannot exhaust file descriptors), and a single consumer goroutine writes
-// every result to the store.
+// every result to the store through a store.Batch, so rows are committed in
+// large transactions rather than one at a time. Files whose size, mtime and
+// inode match their row are neither hashed nor rewritten. Excluded entries (see
+// Options, and IgnoreFile) are skipped, excluded directories without being
+// read. Once the walk finishes, rows under the root for files that were not
+// seen are pruned. In size-first mode the walk only records metadata and a
+// second pass then hashes the files whose size collides. Every run is recorded
+// in the store (see store.Run) with its options, timings and counts.
 package index
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/fs"
-	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -24,90 +37,586 @@ type Options struct {
 	// Hash, when true, computes content hashes for regular files. When false
 	// (the -no-hash flag) only path/size/modtime are recorded.
 	Hash bool
-	// Quick, when true, skips files already present in the store (incremental
-	// re-index) rather than re-hashing them.
+	// Quick, when true, skips files already present in the store, even if they
+	// have changed since.
 	Quick bool
+	// Rehash, when true, hashes every regular file again. By default a file
+	// whose size, mtime and inode match its row keeps the recorded hashes and
+	// is not rewritten; anything else is hashed and its row updated.
+	Rehash bool
 	// Workers is the maximum number of concurrent hashing goroutines. Values
 	// <= 0 default to runtime.NumCPU().
 	Workers int
+	// BatchSize and BatchInterval bound how many rows, and how much time, go
+	// into one store transaction. Values <= 0 select the store defaults.
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// Exclude lists glob patterns (filepath.Match syntax) for entries to leave
+	// out. A pattern containing a path separator is matched against the full
+	// path, any other against the base name.
+	Exclude []string
+	// ExcludeRegexp lists regular expressions matched against the full path.
+	ExcludeRegexp []*regexp.Regexp
+	// PruneNames and PrunePaths name directories that are not descended into:
+	// by base name (e.g. ".git") and by absolute path (e.g. "/proc").
+	PruneNames []string
+	PrunePaths []string
+	// OneFilesystem, when true, does not descend into directories on a
+	// different device from root, like find -xdev.
+	OneFilesystem bool
+	// PruneFS lists filesystem types (see DefaultPruneFS) whose mount points
+	// below root are not descended into, and PruneBindMounts does the same for
+	// bind mounts, whose files are already indexed where they are mounted
+	// from. Mounts are read from MountInfo, which defaults to DefaultMountInfo.
+	PruneFS         []string
+	PruneBindMounts bool
+	MountInfo       string
+	// HashAlgo names the registered Hasher computing full-content digests;
+	// empty selects DefaultHashAlgo. Files whose recorded digest is from
+	// another algorithm are hashed again.
+	HashAlgo string
+	// History, when true, records in the store's history table every file
+	// the run adds, modifies or deletes (see store.Store.RecordHistory), and
+	// then drops history older than HistoryKeep, unless that is 0.
+	History     bool
+	HistoryKeep time.Duration
+	// SizeFirst, with Hash, walks without hashing and then hashes only the
+	// files that can have duplicates (see HashCollisions) rather than every
+	// regular file. Files with a unique size are left unhashed.
+	SizeFirst bool
+	// Resume, when the last run of root did not finish, continues it from its
+	// checkpoint (see store.Run.Checkpoint): entries it had already indexed
+	// are walked, so that pruning still sees them, but not indexed again. The
+	// last run must have used the same options; otherwise, or if it finished,
+	// the whole tree is indexed as usual.
+	Resume bool
+	// Progress, if not nil, is called with how far the run has got every
+	// ProgressInterval (DefaultProgressInterval if it is 0) and once more when
+	// the run ends. It is called from a goroutine of its own, one call at a
+	// time.
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+	// MaxErrors, if not 0, stops the run once that many paths have failed,
+	// and FailFast stops it at the first; the run then fails with
+	// ErrTooManyErrors, without pruning. By default paths that fail are only
+	// counted in the Result.
+	MaxErrors int
+	FailFast  bool
+	// BytesPerSec caps how fast the run reads files to hash them, in total
+	// across the workers, so that indexing does not starve other users of
+	// the disks. 0 means no limit.
+	BytesPerSec int64
+	// DeviceWorkers, if not 0, is the most files hashed at once from any one
+	// device (store.FileInfo.Device), within the Workers overall: a spinning
+	// disk slows down when read in many places at once, while files on other
+	// devices can still be hashed in parallel. The walk does not wait for a
+	// busy device: its files queue in memory until one of its workers is
+	// free, up to queuedPerWorker files per worker across all devices, and
+	// only then does the walk wait. Files whose device is not known count as
+	// being on the same device.
+	DeviceWorkers int
 }
 
-// Run indexes the tree rooted at root into s according to opts.
-func Run(s *store.Store, root string, opts Options) error {
-	workers := opts.Workers
-	if workers <= 0 {
-		workers = runtime.NumCPU()
+// Run indexes the tree rooted at root into s according to opts, then prunes
+// rows under root for files that no longer exist. With opts.SizeFirst it then
+// hashes the files whose size collides with another's; see HashCollisions.
+// Each run is recorded in the store's runs table with what it did, which Run
+// also returns, along with the paths that could not be indexed: those do not
+// make it fail unless opts.MaxErrors or opts.FailFast says so.
+//
+// When ctx is cancelled the walk stops, the files being hashed are abandoned
+// (their rows are left as they were), and the rows already processed are
+// written before Run returns ctx's error. Pruning and size-first hashing are
+// skipped, since they need a complete walk. The run is recorded as cancelled
+// and how far it got is logged; running it again picks up the rest, as
+// unchanged files are not hashed again, and with opts.Resume it does not
+// look at the files already indexed at all.
+func Run(ctx context.Context, s *store.Store, root string, opts Options) (Result, error) {
+	var res Result
+	f, err := newFilter(root, opts)
+	if err != nil {
+		return res, err
 	}
+	full, err := LookupHasher(opts.HashAlgo)
+	if err != nil {
+		return res, err
+	}
+	opts.HashAlgo = full.Name()
 
-	results := make(chan store.FileInfo)
-	sem := make(chan struct{}, workers) // bounds concurrent hashers
-	var wg sync.WaitGroup
-
-	// Consumer: drain results into the store until the channel is closed.
-	consumerDone := make(chan struct{})
-	go func() {
-		defer close(consumerDone)
-		for fi := range results {
-			if err := s.Upsert(fi, opts.Quick); err != nil {
-				log.Error().Err(err).Str("path", fi.Path).Msg("failed to upsert file")
-			}
+	r := store.Run{Root: root, Options: opts.String(), Started: time.Now()}
+	if opts.Resume {
+		if r.Resumed, r.Checkpoint, err = resumePoint(s, root, r.Options); err != nil {
+			return res, err
 		}
-	}()
+	}
+	if r.ID, err = s.BeginRun(r); err != nil {
+		return res, err
+	}
+	if opts.History {
+		s.RecordHistory(r.ID)
+	}
 
-	walkErr := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			log.Error().Err(err).Str("path", path).Msg("walk error")
-			return nil // skip this entry, keep walking
+	// runCtx is also cancelled when too many paths have failed.
+	runCtx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	c := new(counts)
+	c.errs.max, c.errs.stop = opts.MaxErrors, stop
+	if opts.FailFast {
+		c.errs.max = 1
+	}
+	stopProgress := c.reportProgress(opts.Progress, opts.ProgressInterval)
+	err = run(runCtx, s, root, f, full, opts, c, r.ID, r.Checkpoint)
+	stopProgress()
+	if cause := context.Cause(runCtx); errors.Is(cause, ErrTooManyErrors) {
+		err = cause
+	}
+	if opts.History {
+		s.RecordHistory(0)
+		if err == nil && opts.HistoryKeep > 0 {
+			err = s.PruneHistory(time.Now().Add(-opts.HistoryKeep))
 		}
+	}
 
-		fi := store.FileInfo{Path: path, Size: info.Size(), ModTime: info.ModTime()}
+	r.Finished, r.Status = time.Now(), store.RunDone
+	switch {
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		r.Status = store.RunCancelled
+	case err != nil:
+		r.Status = store.RunFailed
+	}
+	c.record(&r)
+	if r.Status == store.RunCancelled {
+		log.Warn().Str("root", root).Str("last", c.lastPath()).
+			Int64("seen", r.Seen).Int64("hashed", r.Hashed).
+			Int64("inserted", r.Inserted).Int64("updated", r.Updated).
+			Msg("indexing cancelled; rows written so far are kept")
+	}
+	if eerr := s.EndRun(r); eerr != nil && err == nil {
+		err = eerr
+	}
+	res.Run = r
+	c.errs.result(&res)
+	return res, err
+}
 
-		if !shouldHash(s, path, info, opts) {
-			results <- fi
-			return nil
-		}
+// resumePoint returns the run of root that a resumed run continues, and its
+// checkpoint: the last run of root on this host, if it did not finish, used
+// options and recorded a checkpoint. It returns 0 and "" if there is none.
+func resumePoint(s *store.Store, root, options string) (int64, string, error) {
+	runs, err := s.Runs("")
+	if err != nil {
+		return 0, "", err
+	}
+	i := slices.IndexFunc(runs, func(r store.Run) bool { return r.Root == root })
+	if i < 0 {
+		log.Info().Str("root", root).Msg("no earlier run to resume; indexing everything")
+		return 0, "", nil
+	}
+	last := runs[i]
+	switch {
+	case last.Status == store.RunDone:
+		log.Info().Str("root", root).Int64("run", last.ID).Msg("last run finished; indexing everything")
+	case last.Checkpoint == "":
+		log.Info().Str("root", root).Int64("run", last.ID).Msg("last run recorded no checkpoint; indexing everything")
+	case last.Options != options:
+		log.Warn().Str("root", root).Int64("run", last.ID).Str("options", last.Options).
+			Msg("last run used other options, so it cannot be resumed; indexing everything")
+	default:
+		log.Info().Str("root", root).Int64("run", last.ID).Str("checkpoint", last.Checkpoint).Msg("resuming run")
+		return last.ID, last.Checkpoint, nil
+	}
+	return 0, "", nil
+}
+
+// run does the work of Run, tallying it in c and recording checkpoints for
+// the run with ID id. Entries up to checkpoint, if it is not "", were indexed
+// by the run being resumed and are only walked.
+func run(ctx context.Context, s *store.Store, root string, f *filter, full Hasher, opts Options, c *counts, id int64, checkpoint string) error {
+	// Size-first walks record sizes only; HashCollisions hashes afterwards.
+	walkOpts := opts
+	if opts.SizeFirst {
+		walkOpts.Hash = false
+	}
 
-		wg.Add(1)
-		sem <- struct{}{}
-		go func() {
-			defer wg.Done()
-			defer func() { <-sem }()
+	p := newPipeline(ctx, s, opts, c, id)
+	w := newWalkState()
+	w.onFail = func(path string, err error) { c.fail(path, kindOf(err), err) }
+	walkErr := walk(ctx, root, f, w, func(path string, info fs.FileInfo) {
+		c.walked(path, info.IsDir())
+		n := p.cp.visit(path, info.IsDir())
+		if checkpoint != "" && indexedBefore(path, checkpoint) {
+			p.cp.settle(n)
+			return
+		}
+		fi := store.FileInfo{
+			Path:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Type:    store.TypeOf(info.Mode()),
+			Mode:    info.Mode(),
+		}
+		fillStat(&fi, info)
 
-			imo, xxh, err := hashFile(path)
+		hash, write := plan(s, &fi, info, walkOpts)
+		if !write {
+			p.cp.settle(n)
+			return
+		}
+		if !hash {
+			p.put(fi, n)
+			return
+		}
+		p.hash(fi, n, func(fi *store.FileInfo) error {
+			imo, digest, _, err := hashPath(ctx, fi.Path, true, full, p.lim)
 			if err != nil {
-				log.Error().Err(err).Str("path", path).Msg("failed to hash file; recording unhashed")
-			} else {
-				fi.Imohash, fi.XXH3Hash = imo, xxh
+				return err
 			}
-			results <- fi
-		}()
-		return nil
+			fi.Imohash, fi.Hash, fi.HashAlgo = imo, digest, full.Name()
+			return nil
+		})
 	})
-
-	wg.Wait()
-	close(results)
-	<-consumerDone
+	c.seen.Add(int64(len(w.seen)))
+	if walkErr == nil {
+		p.cp.walked()
+	}
+	if err := p.close(); err != nil {
+		return fmt.Errorf("flush index of %q: %w", root, err)
+	}
 
 	if walkErr != nil {
 		return fmt.Errorf("walk %q: %w", root, walkErr)
 	}
+	if err := ctx.Err(); err != nil {
+		return err // files still being hashed were abandoned
+	}
+	if err := prune(s, root, w); err != nil {
+		return err
+	}
+	if opts.SizeFirst && opts.Hash {
+		return hashCollisions(ctx, s, opts, c)
+	}
 	return nil
 }
 
-// shouldHash reports whether a dirent should be hashed: it must be a regular
-// file, hashing must be enabled, and in quick mode it must not already be in
-// the store.
-func shouldHash(s *store.Store, path string, info fs.FileInfo, opts Options) bool {
-	if !opts.Hash || !info.Mode().IsRegular() {
-		return false
+// counts tallies what an indexing pass did, for its store.Run record and its
+// Progress reports. The hashing workers update it concurrently.
+type counts struct {
+	seen, hashed, inserted, updated, errors atomic.Int64
+
+	dirs, files atomic.Int64           // entries walked so far
+	hashedBytes atomic.Int64           // the size of the files hashed
+	last        atomic.Pointer[string] // the last path walked
+
+	errs errorLog
+}
+
+// fail records that path could not be indexed, or its row not written.
+func (c *counts) fail(path string, kind ErrorKind, err error) {
+	c.errors.Add(1)
+	c.errs.add(path, kind, err)
+}
+
+// walked counts the entry path, which the walk has just reached.
+func (c *counts) walked(path string, dir bool) {
+	if dir {
+		c.dirs.Add(1)
+	} else {
+		c.files.Add(1)
+	}
+	c.last.Store(&path)
+}
+
+// lastPath returns the last path walked, or "" if the walk saw nothing.
+func (c *counts) lastPath() string {
+	if p := c.last.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// record copies the counts into r.
+func (c *counts) record(r *store.Run) {
+	r.Seen, r.Hashed = c.seen.Load(), c.hashed.Load()
+	r.Inserted, r.Updated = c.inserted.Load(), c.updated.Load()
+	r.Errors = c.errors.Load()
+}
+
+// String describes the options that shape what a run indexes, for the runs
+// table: the hashing mode, then any exclusions, as space-separated words.
+// PruneFS is abbreviated when it is DefaultPruneFS.
+func (o Options) String() string {
+	var words []string
+	add := func(on bool, word string) {
+		if on {
+			words = append(words, word)
+		}
+	}
+	algo := o.HashAlgo
+	if algo == "" {
+		algo = DefaultHashAlgo
+	}
+	add(o.Hash, "hash="+algo)
+	add(!o.Hash, "no-hash")
+	add(o.Quick, "quick")
+	add(o.Rehash, "rehash")
+	add(o.SizeFirst, "size-first")
+	add(o.History, "history")
+	add(o.OneFilesystem, "one-filesystem")
+	add(o.PruneBindMounts, "prune-bind-mounts")
+	list := func(name string, vals []string) {
+		add(len(vals) > 0, name+"="+strings.Join(vals, ","))
+	}
+	list("exclude", o.Exclude)
+	var res []string
+	for _, re := range o.ExcludeRegexp {
+		res = append(res, re.String())
+	}
+	list("exclude-regex", res)
+	list("prune-names", o.PruneNames)
+	list("prune-paths", o.PrunePaths)
+	if slices.Equal(o.PruneFS, DefaultPruneFS) {
+		words = append(words, "prune-fs=default")
+	} else {
+		list("prune-fs", o.PruneFS)
 	}
+	return strings.Join(words, " ")
+}
+
+// queuedPerWorker bounds the files waiting for a busy device, across all
+// devices, as a multiple of Options.Workers.
+const queuedPerWorker = 4
+
+// LastHistoryRun returns the newest of runs, which come newest first as
+// store.Store.Runs returns them, that finished after recording history.
+func LastHistoryRun(runs []store.Run) (store.Run, bool) {
+	for _, r := range runs {
+		if r.Status == store.RunDone && slices.Contains(strings.Fields(r.Options), "history") {
+			return r, true
+		}
+	}
+	return store.Run{}, false
+}
+
+// pipeline is the hashing and writing end of an indexing pass: rows are hashed
+// on a bounded pool of worker goroutines (so a large tree cannot exhaust file
+// descriptors) and a single consumer goroutine writes every row to the store
+// through a store.Batch.
+type pipeline struct {
+	ctx     context.Context
+	opts    Options
+	counts  *counts
+	results chan result
+	sem     chan struct{}          // bounds concurrent hashers
+	devs    map[uint64]*deviceJobs // nil unless hashers are bounded per device
+	devMu   sync.Mutex             // guards the deviceJobs
+	queued  chan struct{}          // bounds the jobs waiting in the deviceJobs
+	lim     *rateLimiter           // paces the hashers' reads; nil for no limit
+	wg      sync.WaitGroup
+	batch   *store.Batch
+	cp      *checkpointer // nil unless the pipeline records checkpoints
+	done    chan struct{}
+}
+
+// result is a row to write, and the checkpointer's number for its entry.
+type result struct {
+	fi store.FileInfo
+	n  int64
+}
+
+// job is a row to hash with fn, then write.
+type job struct {
+	fi store.FileInfo
+	n  int64
+	fn func(*store.FileInfo) error
+}
+
+// deviceJobs is the work on one device when Options.DeviceWorkers bounds it:
+// how many workers are hashing its files, and the files waiting for one of
+// them to be done.
+type deviceJobs struct {
+	active  int
+	waiting []job
+}
+
+// newPipeline starts a pipeline writing to s. If run is not 0, it records
+// that run's checkpoints as the entries numbered by p.cp are written.
+func newPipeline(ctx context.Context, s *store.Store, opts Options, c *counts, run int64) *pipeline {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	p := &pipeline{
+		ctx:     ctx,
+		opts:    opts,
+		counts:  c,
+		results: make(chan result),
+		sem:     make(chan struct{}, workers),
+		lim:     newRateLimiter(opts.BytesPerSec, realClock{}),
+		batch:   s.NewBatch(opts.BatchSize, opts.BatchInterval),
+		done:    make(chan struct{}),
+	}
+	if opts.DeviceWorkers > 0 {
+		p.devs = make(map[uint64]*deviceJobs)
+		p.queued = make(chan struct{}, queuedPerWorker*workers)
+	}
+	if run != 0 {
+		p.cp = newCheckpointer(run, p.batch)
+	}
+	// Consumer: drain results into the store until the channel is closed.
+	go func() {
+		defer close(p.done)
+		for r := range p.results {
+			if err := p.batch.Put(r.fi, opts.Quick); err != nil {
+				c.fail(r.fi.Path, ErrStore, err)
+				log.Error().Err(err).Str("path", r.fi.Path).Msg("failed to upsert file")
+			}
+			p.dropped()
+			p.cp.settle(r.n)
+		}
+	}()
+	return p
+}
+
+// put queues fi, entry n, to be written as is.
+func (p *pipeline) put(fi store.FileInfo, n int64) {
+	p.results <- result{fi, n}
+}
+
+// hash runs fn on fi, entry n, in a worker, blocking while all workers are
+// busy, and then queues fi to be written. If fn fails the error is logged and
+// fi is written as fn left it, normally without the hashes it could not
+// compute; if it fails because the pipeline's context was cancelled, fi is
+// dropped, and entry n never settles.
+//
+// With Options.DeviceWorkers, a file whose device already has that many
+// workers waits in the device's queue, and one of them takes it on when it
+// is done, so the walk goes on to files on other devices rather than waiting
+// for a busy one. Once queuedPerWorker files per worker are waiting, hash
+// blocks until one of them is taken on.
+func (p *pipeline) hash(fi store.FileInfo, n int64, fn func(*store.FileInfo) error) {
+	j := job{fi, n, fn}
+	p.wg.Add(1)
+	var dev *deviceJobs
+	if p.devs != nil {
+		dev = p.devs[fi.Device]
+		if dev == nil {
+			dev = new(deviceJobs)
+			p.devs[fi.Device] = dev
+		}
+		p.devMu.Lock()
+		if dev.active == p.opts.DeviceWorkers {
+			p.devMu.Unlock()
+			p.queued <- struct{}{}
+			p.devMu.Lock()
+			// One of the device's workers may have finished while the walk
+			// waited for room in the queue.
+			if dev.active == p.opts.DeviceWorkers {
+				dev.waiting = append(dev.waiting, j)
+				p.devMu.Unlock()
+				return
+			}
+			<-p.queued
+		}
+		dev.active++
+		p.devMu.Unlock()
+	}
+	p.sem <- struct{}{}
+	go func() {
+		defer func() { <-p.sem }()
+		for {
+			p.work(j)
+			if dev == nil {
+				return
+			}
+			p.devMu.Lock()
+			if len(dev.waiting) == 0 {
+				dev.active--
+				p.devMu.Unlock()
+				return
+			}
+			j, dev.waiting = dev.waiting[0], dev.waiting[1:]
+			p.devMu.Unlock()
+			<-p.queued
+		}
+	}()
+}
+
+// work hashes and queues j's row, on a worker.
+func (p *pipeline) work(j job) {
+	defer p.wg.Done()
+	if p.ctx.Err() != nil {
+		return // abandoned while waiting for its device
+	}
+
+	err := j.fn(&j.fi)
+	switch {
+	case err != nil && p.ctx.Err() != nil:
+		return
+	case err != nil:
+		p.counts.fail(j.fi.Path, kindOf(err), err)
+		log.Error().Err(err).Str("path", j.fi.Path).Msg("failed to hash file; recording it without that hash")
+	default:
+		p.counts.hashed.Add(1)
+		p.counts.hashedBytes.Add(j.fi.Size)
+	}
+	p.results <- result{j.fi, j.n}
+}
+
+// close waits for the workers, then writes and commits every queued row.
+func (p *pipeline) close() error {
+	p.wg.Wait()
+	close(p.results)
+	<-p.done
+	err := p.batch.Close()
+	p.dropped()
+	inserted, updated := p.batch.Written()
+	p.counts.inserted.Add(inserted)
+	p.counts.updated.Add(updated)
+	return err
+}
+
+// dropped records the rows that the batch wrote, but then lost.
+func (p *pipeline) dropped() {
+	for _, e := range p.batch.Failed() {
+		p.counts.fail(e.Path, ErrStore, e.Err)
+		log.Error().Err(e.Err).Str("path", e.Path).Msg("failed to write file's row")
+	}
+}
+
+// plan decides what to do with a walked entry: whether it must be hashed, and
+// whether its row needs writing at all. An entry that matches its row keeps the
+// recorded hashes, which plan copies into fi.
+func plan(s *store.Store, fi *store.FileInfo, info fs.FileInfo, opts Options) (hash, write bool) {
+	wantHash := opts.Hash && info.Mode().IsRegular()
+
 	if opts.Quick {
-		has, err := s.Has(path)
+		has, err := s.Has(fi.Path)
 		if err != nil {
-			log.Error().Err(err).Str("path", path).Msg("quick existence check failed; hashing anyway")
-			return true
+			log.Error().Err(err).Str("path", fi.Path).Msg("quick existence check failed; hashing anyway")
+			return wantHash, true
 		}
-		return !has
+		return wantHash && !has, !has
+	}
+	if opts.Rehash {
+		return wantHash, true
+	}
+
+	old, ok, err := s.Lookup(fi.Path)
+	if err != nil {
+		log.Error().Err(err).Str("path", fi.Path).Msg("change check failed; hashing anyway")
+		return wantHash, true
+	}
+	if !ok || !fi.Unchanged(old) {
+		return wantHash, true
+	}
+	// Unchanged, but indexed without hashes (e.g. by -no-hash) or with another
+	// algorithm last time.
+	if wantHash && (old.Hash == "" || old.HashAlgo != opts.HashAlgo) && fi.Size > 0 {
+		return true, true
 	}
-	return true
+	fi.Imohash, fi.Hash, fi.HashAlgo = old.Imohash, old.Hash, old.HashAlgo
+	// Content is unchanged, but metadata such as the mode, owner or link count
+	// may not be, and rows from older versions lack the stat fields.
+	return false, !fi.Equal(old)
 }
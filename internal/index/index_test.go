@@ -1,10 +1,13 @@
 package index
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/iggy/gocate/internal/store"
 )
@@ -39,22 +42,22 @@ func TestRunHashesAndDetectsDuplicates(t *testing.T) {
 	s := openStore(t)
 	root := buildTree(t)
 
-	if err := Run(s, root, Options{Hash: true, Workers: 2}); err != nil {
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, Workers: 2}); err != nil {
 		t.Fatalf("Run: %v", err)
 	}
 
 	// f1 and f2 share content -> one duplicate group.
-	groups, err := s.Duplicates()
+	groups, err := s.Duplicates("")
 	if err != nil {
 		t.Fatalf("Duplicates: %v", err)
 	}
-	if len(groups) != 1 || len(groups[0]) != 2 {
+	if len(groups) != 1 || len(groups[0].Copies) != 2 {
 		t.Fatalf("got dup groups %+v, want one group of 2", groups)
 	}
 
 	// The three regular files should be searchable; the symlink target is the
 	// same path, so search by extension finds all .txt files.
-	files, err := s.Search(`\.txt$`)
+	files, err := s.Search("", `\.txt$`)
 	if err != nil {
 		t.Fatalf("Search: %v", err)
 	}
@@ -67,11 +70,11 @@ func TestRunNoHash(t *testing.T) {
 	s := openStore(t)
 	root := buildTree(t)
 
-	if err := Run(s, root, Options{Hash: false}); err != nil {
+	if _, err := Run(t.Context(), s, root, Options{Hash: false}); err != nil {
 		t.Fatalf("Run: %v", err)
 	}
 
-	files, err := s.Search(`\.txt$`)
+	files, err := s.Search("", `\.txt$`)
 	if err != nil {
 		t.Fatalf("Search: %v", err)
 	}
@@ -79,7 +82,7 @@ func TestRunNoHash(t *testing.T) {
 		t.Fatalf("got %d .txt rows, want 3", len(files))
 	}
 	for _, f := range files {
-		if f.XXH3Hash != "" || f.Imohash != "" {
+		if f.Hash != "" || f.Imohash != "" {
 			t.Fatalf("no-hash run produced hashes for %q", f.Path)
 		}
 	}
@@ -90,21 +93,504 @@ func TestRunQuickSkipsExisting(t *testing.T) {
 	root := buildTree(t)
 
 	// First pass with no hashing: rows exist but unhashed.
-	if err := Run(s, root, Options{Hash: false}); err != nil {
+	if _, err := Run(t.Context(), s, root, Options{Hash: false}); err != nil {
 		t.Fatalf("Run no-hash: %v", err)
 	}
 	// Quick pass: existing rows are skipped, so they remain unhashed.
-	if err := Run(s, root, Options{Hash: true, Quick: true, Workers: runtime.NumCPU()}); err != nil {
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, Quick: true, Workers: runtime.NumCPU()}); err != nil {
 		t.Fatalf("Run quick: %v", err)
 	}
 
-	files, err := s.Search(`\.txt$`)
+	files, err := s.Search("", `\.txt$`)
 	if err != nil {
 		t.Fatalf("Search: %v", err)
 	}
 	for _, f := range files {
-		if f.XXH3Hash != "" {
+		if f.Hash != "" {
 			t.Fatalf("quick run re-hashed existing file %q", f.Path)
 		}
 	}
 }
+
+func TestRunPrunesDeletedFiles(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "sub")); err != nil {
+		t.Fatalf("remove sub: %v", err)
+	}
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+
+	files, err := s.Search("", `/sub`)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("deleted subtree still indexed: %+v", files)
+	}
+	files, err = s.Search("", `\.txt$`)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d .txt rows, want 2", len(files))
+	}
+}
+
+func TestPruneOnly(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	outside := t.TempDir()
+	writeFile(t, outside, "keep.txt", "outside the pruned root")
+
+	if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, err := Run(t.Context(), s, outside, Options{}); err != nil {
+		t.Fatalf("Run outside: %v", err)
+	}
+	if err := os.Remove(filepath.Join(root, "f1.txt")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	// Removing the outside tree must not affect a prune scoped to root.
+	if err := os.RemoveAll(outside); err != nil {
+		t.Fatalf("remove outside: %v", err)
+	}
+	if err := Prune(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+
+	files, err := s.Search("", `\.txt$`)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, f := range files {
+		got[filepath.Base(f.Path)] = true
+	}
+	if got["f1.txt"] || !got["f2.txt"] || !got["f3.txt"] || !got["keep.txt"] {
+		t.Fatalf("after prune got %v, want f2.txt, f3.txt and keep.txt", got)
+	}
+}
+
+func TestPruneKeepsFailedSubtrees(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// Simulate a walk that could not read sub/ (e.g. permission denied): nothing
+	// below it was seen, but its rows must survive.
+	w := newWalkState()
+	w.see(root)
+	w.see(filepath.Join(root, "f1.txt"))
+	w.fail(filepath.Join(root, "sub"), os.ErrPermission)
+	if err := prune(s, root, w); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	paths, err := s.Paths(root)
+	if err != nil {
+		t.Fatalf("Paths: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, p := range paths {
+		got[p] = true
+	}
+	for _, want := range []string{root, filepath.Join(root, "f1.txt"), filepath.Join(root, "sub"), filepath.Join(root, "sub", "f3.txt")} {
+		if !got[want] {
+			t.Errorf("row %q was pruned", want)
+		}
+	}
+	if got[filepath.Join(root, "f2.txt")] {
+		t.Error("unseen f2.txt was not pruned")
+	}
+}
+
+func TestRunKeepsUnreadableSubtree(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks do not apply to root")
+	}
+	s := openStore(t)
+	root := buildTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	sub := filepath.Join(root, "sub")
+	if err := os.Chmod(sub, 0o000); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(sub, 0o755) })
+	res, err := Run(t.Context(), s, root, Options{})
+	if err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+	if res.Errors[ErrPermission] != 1 || res.Samples[ErrPermission][0].Path != sub {
+		t.Fatalf("Run again reported errors %v, %v; want a permission error for sub", res.Errors, res.Samples)
+	}
+
+	files, err := s.Search("", `f3\.txt$`)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatal("row under a permission-denied directory was pruned")
+	}
+}
+
+// tamper overwrites the stored hashes for path while keeping its metadata, so
+// a later run reveals whether the file was hashed again.
+func tamper(t *testing.T, s *store.Store, path string) {
+	t.Helper()
+	fi, ok, err := s.Lookup(path)
+	if err != nil || !ok {
+		t.Fatalf("Lookup %s: %v %v", path, ok, err)
+	}
+	fi.Imohash, fi.Hash = "stale", "stale"
+	if err := s.Upsert(fi, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+}
+
+func TestRunSkipsUnchangedFiles(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	tamper(t, s, f1)
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+	if fi, _, _ := s.Lookup(f1); fi.Hash != "stale" {
+		t.Fatalf("unchanged file was hashed again: %+v", fi)
+	}
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, Rehash: true}); err != nil {
+		t.Fatalf("Run rehash: %v", err)
+	}
+	if fi, _, _ := s.Lookup(f1); fi.Hash == "stale" {
+		t.Fatal("-rehash did not hash the unchanged file")
+	}
+}
+
+func TestRunRehashesChangedFiles(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	before, _, _ := s.Lookup(f1)
+
+	// Same size, new content and mtime: only the mtime gives the edit away.
+	writeFile(t, root, "f1.txt", "DUPLICATE CONTENT")
+	mtime := before.ModTime.Add(time.Minute)
+	if err := os.Chtimes(f1, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+
+	after, _, _ := s.Lookup(f1)
+	if after.Hash == before.Hash {
+		t.Fatal("edited file kept its old hash")
+	}
+	if !after.ModTime.Equal(mtime) {
+		t.Fatalf("mtime = %v, want %v", after.ModTime, mtime)
+	}
+	if after.Inode == 0 {
+		t.Fatal("inode not recorded")
+	}
+}
+
+func TestRunNoHashRecordsMetadataChanges(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	writeFile(t, root, "f1.txt", "longer content than before")
+	if _, err := Run(t.Context(), s, root, Options{Hash: false}); err != nil {
+		t.Fatalf("Run no-hash: %v", err)
+	}
+
+	fi, _, _ := s.Lookup(f1)
+	if fi.Size != int64(len("longer content than before")) {
+		t.Fatalf("size = %d, want the new size", fi.Size)
+	}
+	if fi.Hash != "" {
+		t.Fatalf("changed file kept a stale hash %q", fi.Hash)
+	}
+
+	// Unchanged files keep the hashes recorded by the first run.
+	f2, _, _ := s.Lookup(filepath.Join(root, "f2.txt"))
+	if f2.Hash == "" {
+		t.Fatal("no-hash run dropped the hash of an unchanged file")
+	}
+
+	// A hashing run picks up the file left unhashed.
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if fi, _, _ := s.Lookup(f1); fi.Hash == "" {
+		t.Fatal("hashing run did not hash the file left unhashed")
+	}
+}
+
+func TestRunRecordsStatMetadata(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := map[string]store.FileType{
+		".":      store.TypeDir,
+		"f1.txt": store.TypeFile,
+		"sub":    store.TypeDir,
+		"link":   store.TypeSymlink,
+	}
+	for rel, typ := range want {
+		fi, ok, err := s.Lookup(filepath.Join(root, rel))
+		if err != nil || !ok {
+			t.Fatalf("Lookup %s: %v %v", rel, ok, err)
+		}
+		if fi.Type != typ || store.TypeOf(fi.Mode) != typ {
+			t.Errorf("%s: type %q, mode %v; want %q", rel, fi.Type, fi.Mode, typ)
+		}
+		if runtime.GOOS != "windows" && (fi.Nlink == 0 || fi.Device == 0 || fi.ChangeTime.IsZero()) {
+			t.Errorf("%s: stat fields missing: %+v", rel, fi)
+		}
+	}
+}
+
+func TestRunRecordsMetadataOnlyChanges(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits to change")
+	}
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	tamper(t, s, f1)
+	if err := os.Chmod(f1, 0o600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+
+	fi, _, _ := s.Lookup(f1)
+	if fi.Mode.Perm() != 0o600 {
+		t.Fatalf("mode = %v, want 0600", fi.Mode)
+	}
+	if fi.Hash != "stale" {
+		t.Fatal("a chmod alone caused the file to be hashed again")
+	}
+}
+
+func TestRunCollapsesHardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inodes are not recorded on windows")
+	}
+	s := openStore(t)
+	root := buildTree(t)
+	if err := os.Link(filepath.Join(root, "f1.txt"), filepath.Join(root, "f1-link.txt")); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Copies) != 2 {
+		t.Fatalf("got dup groups %+v, want f1 and its link collapsed next to f2", groups)
+	}
+	if c := groups[0].Copies[0]; len(c) != 2 || c[0].Nlink != 2 {
+		t.Fatalf("first copy = %+v, want f1-link.txt and f1.txt with 2 links", c)
+	}
+
+	// Once f2 is linked too, nothing is left to reclaim.
+	f2 := filepath.Join(root, "f2.txt")
+	if err := os.Remove(f2); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := os.Link(filepath.Join(root, "f1.txt"), f2); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run again: %v", err)
+	}
+	if groups, err := s.Duplicates(""); err != nil || len(groups) != 0 {
+		t.Fatalf("Duplicates after linking = %+v, %v; want none", groups, err)
+	}
+}
+
+func TestRunRecordsRuns(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, Exclude: []string{"*.bak"}}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	writeFile(t, root, "f1.txt", "changed")
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+
+	runs, err := s.Runs("")
+	if err != nil {
+		t.Fatalf("Runs: %v", err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("Runs = %+v, want 2", runs)
+	}
+	second, first := runs[0], runs[1]
+	if first.Root != root || first.Status != store.RunDone || first.Finished.Before(first.Started) {
+		t.Fatalf("first run = %+v", first)
+	}
+	if first.Options != "hash=xxh3 exclude=*.bak" {
+		t.Fatalf("first run options = %q", first.Options)
+	}
+	// root, sub, link and the three files; all new, the three files hashed.
+	if first.Seen != 6 || first.Inserted != 6 || first.Updated != 0 || first.Hashed != 3 || first.Errors != 0 {
+		t.Fatalf("first run counts = %+v", first)
+	}
+	// Only f1 changed: rewriting a file in place leaves its directory alone.
+	if second.Seen != 6 || second.Inserted != 0 || second.Updated != 1 || second.Hashed != 1 {
+		t.Fatalf("second run counts = %+v", second)
+	}
+}
+
+func TestRunRecordsHistory(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+	f2 := filepath.Join(root, "f2.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, History: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	runs, err := s.Runs("")
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Runs = %+v, %v", runs, err)
+	}
+	first := runs[0].ID
+
+	writeFile(t, root, "f1.txt", "changed")
+	if err := os.Remove(f2); err != nil {
+		t.Fatalf("remove f2: %v", err)
+	}
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, History: true, HistoryKeep: time.Hour}); err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+
+	changes, err := s.Changes("", first, 0, time.Time{})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	got := make(map[string]store.ChangeKind)
+	for _, c := range changes {
+		got[c.Path] = c.Kind
+	}
+	if len(got) != 2 || got[f1] != store.Modified || got[f2] != store.Deleted {
+		t.Fatalf("changes since the first run = %+v", changes)
+	}
+
+	// The first run added the three files.
+	all, err := s.Changes("", 0, 0, time.Time{})
+	if err != nil || len(all) != 5 {
+		t.Fatalf("all changes = %+v, %v", all, err)
+	}
+}
+
+// TestLastHistoryRun checks that a run without History, following one with it,
+// does not hide the history run's changes, and that those are told apart from
+// the changes of later runs.
+func TestLastHistoryRun(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, History: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	writeFile(t, root, "f1.txt", "changed")
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, History: true}); err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+	writeFile(t, root, "f4.txt", "new")
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run without history: %v", err)
+	}
+
+	runs, err := s.Runs("")
+	if err != nil || len(runs) != 3 {
+		t.Fatalf("Runs = %+v, %v", runs, err)
+	}
+	r, ok := LastHistoryRun(runs)
+	if !ok || r.ID != runs[1].ID {
+		t.Fatalf("LastHistoryRun = %+v, %v; want the second run %d", r, ok, runs[1].ID)
+	}
+	changes, err := s.Changes("", r.ID-1, r.ID, time.Time{})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Path != f1 || changes[0].Kind != store.Modified {
+		t.Fatalf("changes of the last history run = %+v, want f1.txt modified", changes)
+	}
+
+	if _, ok := LastHistoryRun(runs[:1]); ok {
+		t.Fatal("LastHistoryRun found a history run among runs without history")
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f2 := filepath.Join(root, "f2.txt")
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := os.Remove(f2); err != nil {
+		t.Fatalf("remove f2: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := Run(ctx, s, root, Options{Hash: true}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled Run = %v, want context.Canceled", err)
+	}
+	// The walk did not finish, so nothing was pruned.
+	lookup(t, s, f2)
+
+	runs, err := s.Runs("")
+	if err != nil || len(runs) != 2 {
+		t.Fatalf("Runs = %+v, %v", runs, err)
+	}
+	if runs[0].Status != store.RunCancelled || runs[0].Finished.IsZero() {
+		t.Fatalf("cancelled run = %+v", runs[0])
+	}
+}
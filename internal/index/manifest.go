@@ -0,0 +1,326 @@
+package index
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// xxh3Tag prefixes xxh3 digests in xxhsum's output, telling them apart from
+// the XXH64 digests of the same length.
+const xxh3Tag = "XXH3_"
+
+// ManifestEntry is one line of a checksum manifest: a file and its digest.
+type ManifestEntry struct {
+	Hash string // as written in the manifest, e.g. with xxhsum's XXH3_ tag
+	Path string // relative to the manifest's root, or absolute
+}
+
+// WriteManifest writes the digests recorded for the files at or below root
+// in the `<hash>  <path>` format of sha256sum and xxhsum, with paths relative
+// to root, so `sha256sum -c` (or `xxhsum -c` for xxh3) run from root checks
+// them. Digests are those of opts.HashAlgo; files indexed without one are left
+// out and counted in skipped. Zero-byte files are never hashed when indexing,
+// but their digest is known, so they are listed.
+func WriteManifest(w io.Writer, s *store.Store, root string, opts Options) (skipped int, err error) {
+	full, err := LookupHasher(opts.HashAlgo)
+	if err != nil {
+		return 0, err
+	}
+	empty, err := full.Hash(strings.NewReader(""))
+	if err != nil {
+		return 0, fmt.Errorf("%s of empty input: %w", full.Name(), err)
+	}
+
+	bw := bufio.NewWriter(w)
+	for fi, err := range s.UnderSeq(root) {
+		if err != nil {
+			return skipped, err
+		}
+		if fi.Type != store.TypeFile {
+			continue
+		}
+		digest := fi.Hash
+		switch {
+		case fi.Size == 0:
+			digest = empty
+		case fi.Hash == "" || fi.HashAlgo != full.Name():
+			skipped++
+			continue
+		}
+		rel, err := filepath.Rel(root, fi.Path)
+		if err != nil {
+			return skipped, fmt.Errorf("manifest path for %q: %w", fi.Path, err)
+		}
+		if _, err := bw.WriteString(manifestLine(full.Name(), digest, rel)); err != nil {
+			return skipped, fmt.Errorf("write manifest: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return skipped, fmt.Errorf("write manifest: %w", err)
+	}
+	return skipped, nil
+}
+
+// manifestLine formats one manifest line. As in coreutils, a path holding a
+// backslash or line break has them escaped and the line marked with a
+// leading backslash.
+func manifestLine(algo, digest, path string) string {
+	if algo == "xxh3" {
+		digest = xxh3Tag + canonicalDigest(algo, digest)
+	}
+	prefix := ""
+	if strings.ContainsAny(path, "\\\n\r") {
+		prefix = `\`
+		path = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(path)
+	}
+	return prefix + digest + "  " + path + "\n"
+}
+
+// ReadManifest parses a manifest in the format of sha256sum, md5sum or
+// xxhsum: `<hash>  <path>`, or `<hash> *<path>` for files hashed in binary
+// mode, which is the same thing on Unix. Blank lines are skipped.
+func ReadManifest(r io.Reader) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, `\`)
+		if escaped {
+			line = line[1:]
+		}
+		hash, path, ok := strings.Cut(line, " ")
+		if !ok || hash == "" || len(path) < 2 || (path[0] != ' ' && path[0] != '*') {
+			return nil, fmt.Errorf("manifest line %d: want \"<hash>  <path>\"", n)
+		}
+		path = path[1:]
+		if escaped {
+			var err error
+			if path, err = unescapeManifest(path); err != nil {
+				return nil, fmt.Errorf("manifest line %d: %w", n, err)
+			}
+		}
+		entries = append(entries, ManifestEntry{Hash: hash, Path: path})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// unescapeManifest reverses the escaping of manifestLine.
+func unescapeManifest(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", errors.New("path ends in a lone backslash")
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			return "", fmt.Errorf("unknown escape \\%c in path", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// canonicalDigest puts a digest of algo in the form digests are compared in:
+// lower case, and for xxh3 without the XXH3_ tag but zero-padded to 16 digits,
+// as xxhsum writes it and gocate does not store it.
+func canonicalDigest(algo, digest string) string {
+	digest = strings.ToLower(digest)
+	if algo == "xxh3" {
+		digest = strings.TrimPrefix(digest, strings.ToLower(xxh3Tag))
+		if len(digest) < 16 {
+			digest = strings.Repeat("0", 16-len(digest)) + digest
+		}
+	}
+	return digest
+}
+
+// Verification is the outcome of checking a manifest. Paths are given as
+// the manifest lists them; Extra paths are relative to the root, like the
+// ones WriteManifest writes.
+type Verification struct {
+	Algo       string   // the algorithm the manifest was checked with
+	OK         int      // files whose digest matched
+	Mismatched []string // files whose digest differs
+	Missing    []string // listed files that are not there
+	Unverified []string // listed files that could not be hashed, or are indexed without a digest of Algo
+	Extra      []string // files under the root that the manifest does not list
+}
+
+// Failed reports whether any listed file is missing, differs or could not be
+// checked. Extra files alone do not fail a verification: a manifest often
+// covers only part of a tree.
+func (v *Verification) Failed() bool {
+	return len(v.Mismatched) > 0 || len(v.Missing) > 0 || len(v.Unverified) > 0
+}
+
+// VerifyManifest checks entries against the digests indexed for the files at
+// or below root, without reading any file. Relative manifest paths are taken
+// relative to root.
+//
+// Digests are taken to be of opts.HashAlgo, unless the manifest carries
+// xxhsum's XXH3_ tag; a manifest whose digests are not the length that
+// algorithm produces is rejected rather than reported as all mismatched.
+func VerifyManifest(s *store.Store, root string, entries []ManifestEntry, opts Options) (*Verification, error) {
+	full, empty, err := manifestHasher(entries, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed := make(map[string]store.FileInfo)
+	for fi, err := range s.UnderSeq(root) {
+		if err != nil {
+			return nil, err
+		}
+		if fi.Type == store.TypeFile {
+			indexed[fi.Path] = fi
+		}
+	}
+
+	v := &Verification{Algo: full.Name()}
+	listed := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		path := manifestPath(root, e.Path)
+		listed[path] = struct{}{}
+		fi, ok := indexed[path]
+		switch {
+		case !ok:
+			v.Missing = append(v.Missing, e.Path)
+		case fi.Size == 0:
+			v.check(e, empty)
+		case fi.Hash == "" || fi.HashAlgo != full.Name():
+			v.Unverified = append(v.Unverified, e.Path)
+		default:
+			v.check(e, fi.Hash)
+		}
+	}
+	for path := range indexed {
+		v.extra(root, path, listed)
+	}
+	slices.Sort(v.Extra)
+	return v, nil
+}
+
+// VerifyManifestDisk checks entries against the files on disk, hashing each
+// listed file. Extra files are found by walking root with the exclusions of
+// opts, and the files are read no faster than opts.BytesPerSec; otherwise it
+// works like VerifyManifest. It stops with ctx's error if ctx is cancelled.
+func VerifyManifestDisk(ctx context.Context, root string, entries []ManifestEntry, opts Options) (*Verification, error) {
+	full, empty, err := manifestHasher(entries, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	lim := newRateLimiter(opts.BytesPerSec, realClock{})
+	v := &Verification{Algo: full.Name()}
+	listed := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		path := manifestPath(root, e.Path)
+		listed[path] = struct{}{}
+		_, digest, info, err := hashPath(ctx, path, false, full, lim)
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case errors.Is(err, fs.ErrNotExist):
+			v.Missing = append(v.Missing, e.Path)
+		case err != nil:
+			v.Unverified = append(v.Unverified, e.Path)
+			log.Warn().Err(err).Str("path", path).Msg("cannot verify file")
+		case info.Size() == 0:
+			v.check(e, empty)
+		default:
+			v.check(e, digest)
+		}
+	}
+
+	f, err := newFilter(root, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := walk(ctx, root, f, newWalkState(), func(path string, info fs.FileInfo) {
+		if info.Mode().IsRegular() {
+			v.extra(root, path, listed)
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("walk %q: %w", root, err)
+	}
+	slices.Sort(v.Extra)
+	return v, nil
+}
+
+// check compares an entry's digest with the one computed for its file.
+func (v *Verification) check(e ManifestEntry, digest string) {
+	if canonicalDigest(v.Algo, e.Hash) == canonicalDigest(v.Algo, digest) {
+		v.OK++
+	} else {
+		v.Mismatched = append(v.Mismatched, e.Path)
+	}
+}
+
+// extra records path as extra if the manifest does not list it.
+func (v *Verification) extra(root, path string, listed map[string]struct{}) {
+	if _, ok := listed[path]; ok {
+		return
+	}
+	if rel, err := filepath.Rel(root, path); err == nil {
+		path = rel
+	}
+	v.Extra = append(v.Extra, path)
+}
+
+// manifestPath resolves a manifest path against root.
+func manifestPath(root, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(root, path)
+}
+
+// manifestHasher picks the Hasher to check entries with, and returns the
+// canonical digest of empty input for zero-byte files.
+func manifestHasher(entries []ManifestEntry, opts Options) (full Hasher, empty string, err error) {
+	algo := opts.HashAlgo
+	if len(entries) > 0 && strings.HasPrefix(entries[0].Hash, xxh3Tag) {
+		algo = "xxh3"
+	}
+	if full, err = LookupHasher(algo); err != nil {
+		return nil, "", err
+	}
+	if empty, err = full.Hash(strings.NewReader("")); err != nil {
+		return nil, "", fmt.Errorf("%s of empty input: %w", full.Name(), err)
+	}
+	want := len(canonicalDigest(full.Name(), empty))
+	for _, e := range entries {
+		if got := len(canonicalDigest(full.Name(), e.Hash)); got != want {
+			return nil, "", fmt.Errorf("manifest digest for %q has %d digits, %s digests have %d (see -hash-algo)",
+				e.Path, got, full.Name(), want)
+		}
+	}
+	return full, empty, nil
+}
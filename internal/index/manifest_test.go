@@ -0,0 +1,160 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// exportManifest indexes root with algo and returns its manifest.
+func exportManifest(t *testing.T, root, algo string) string {
+	t.Helper()
+	s := openStore(t)
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, HashAlgo: algo}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var buf bytes.Buffer
+	skipped, err := WriteManifest(&buf, s, root, Options{HashAlgo: algo})
+	if err != nil || skipped != 0 {
+		t.Fatalf("WriteManifest = %d skipped, %v", skipped, err)
+	}
+	return buf.String()
+}
+
+func readManifest(t *testing.T, manifest string) []ManifestEntry {
+	t.Helper()
+	entries, err := ReadManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("ReadManifest: %v", err)
+	}
+	return entries
+}
+
+func TestWriteManifestSha256sumFormat(t *testing.T) {
+	root := buildTree(t)
+	writeFile(t, root, "empty", "")
+
+	sum := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(h[:])
+	}
+	want := sum("") + "  empty\n" +
+		sum("duplicate content") + "  f1.txt\n" +
+		sum("duplicate content") + "  f2.txt\n" +
+		sum("unique content") + "  " + filepath.Join("sub", "f3.txt") + "\n"
+	if got := exportManifest(t, root, "sha256"); got != want {
+		t.Fatalf("manifest:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteManifestXxhsumFormat(t *testing.T) {
+	root := buildTree(t)
+	for _, line := range strings.Split(strings.TrimSpace(exportManifest(t, root, "")), "\n") {
+		hash, _, _ := strings.Cut(line, "  ")
+		if !strings.HasPrefix(hash, xxh3Tag) || len(hash) != len(xxh3Tag)+16 {
+			t.Fatalf("xxh3 manifest line %q, want an XXH3_ tag and 16 digits", line)
+		}
+	}
+}
+
+func TestManifestEscapesPaths(t *testing.T) {
+	root := t.TempDir()
+	name := "odd\\name\nwith newline"
+	writeFile(t, root, name, "content")
+
+	manifest := exportManifest(t, root, "md5")
+	if !strings.HasPrefix(manifest, `\`) || strings.Count(manifest, "\n") != 1 {
+		t.Fatalf("manifest %q, want one escaped line", manifest)
+	}
+	entries := readManifest(t, manifest)
+	if len(entries) != 1 || entries[0].Path != name {
+		t.Fatalf("entries = %+v, want path %q", entries, name)
+	}
+}
+
+func TestReadManifestFormats(t *testing.T) {
+	entries := readManifest(t, "abc  text.txt\n\nDEF *bin ary.dat\r\n")
+	want := []ManifestEntry{{"abc", "text.txt"}, {"DEF", "bin ary.dat"}}
+	if !slices.Equal(entries, want) {
+		t.Fatalf("entries = %+v, want %+v", entries, want)
+	}
+	if _, err := ReadManifest(strings.NewReader("abc text.txt\n")); err == nil {
+		t.Fatal("ReadManifest accepted a line with a single space")
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, HashAlgo: "sha256"}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := WriteManifest(&buf, s, root, Options{HashAlgo: "sha256"}); err != nil {
+		t.Fatalf("WriteManifest: %v", err)
+	}
+	entries := readManifest(t, buf.String())
+
+	v, err := VerifyManifest(s, root, entries, Options{HashAlgo: "sha256"})
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if v.Failed() || v.OK != 3 || len(v.Extra) != 0 {
+		t.Fatalf("verifying an exported manifest = %+v", v)
+	}
+
+	// Drop f2, corrupt f1's digest and list a file that was never indexed.
+	var edited []ManifestEntry
+	for _, e := range entries {
+		switch e.Path {
+		case "f1.txt":
+			e.Hash = strings.Repeat("0", 64)
+		case "f2.txt":
+			continue
+		}
+		edited = append(edited, e)
+	}
+	edited = append(edited, ManifestEntry{strings.Repeat("1", 64), filepath.Join(root, "gone.txt")})
+
+	v, err = VerifyManifest(s, root, edited, Options{HashAlgo: "sha256"})
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if !v.Failed() || v.OK != 1 ||
+		!slices.Equal(v.Mismatched, []string{"f1.txt"}) ||
+		!slices.Equal(v.Missing, []string{filepath.Join(root, "gone.txt")}) ||
+		!slices.Equal(v.Extra, []string{"f2.txt"}) {
+		t.Fatalf("verifying an edited manifest = %+v", v)
+	}
+
+	// Digests of another algorithm are rejected up front.
+	if _, err := VerifyManifest(s, root, entries, Options{HashAlgo: "md5"}); err == nil {
+		t.Fatal("VerifyManifest accepted sha256 digests as md5")
+	}
+}
+
+func TestVerifyManifestDisk(t *testing.T) {
+	root := buildTree(t)
+	entries := readManifest(t, exportManifest(t, root, ""))
+
+	// The index still has the old digest; the disk does not.
+	if err := os.WriteFile(filepath.Join(root, "f1.txt"), []byte("changed content!!"), 0o644); err != nil {
+		t.Fatalf("rewrite f1: %v", err)
+	}
+	writeFile(t, root, "new.txt", "new")
+
+	v, err := VerifyManifestDisk(t.Context(), root, entries, Options{})
+	if err != nil {
+		t.Fatalf("VerifyManifestDisk: %v", err)
+	}
+	if v.Algo != "xxh3" || v.OK != 2 ||
+		!slices.Equal(v.Mismatched, []string{"f1.txt"}) ||
+		!slices.Equal(v.Extra, []string{"new.txt"}) || len(v.Missing) != 0 {
+		t.Fatalf("verifying against disk = %+v", v)
+	}
+}
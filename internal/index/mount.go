@@ -0,0 +1,143 @@
+package index
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMountInfo is where the mount table of the running process is read
+// from when Options.MountInfo is empty.
+const DefaultMountInfo = "/proc/self/mountinfo"
+
+// DefaultPruneFS lists filesystem types that hold no real files worth
+// indexing: kernel pseudo filesystems, memory-backed mounts, and network and
+// FUSE mounts that are slow or may hang. It mirrors updatedb's usual PRUNEFS.
+var DefaultPruneFS = []string{
+	"9p", "afs", "anon_inodefs", "autofs", "bdev", "binfmt_misc", "bpf",
+	"cgroup", "cgroup2", "cifs", "coda", "configfs", "cpuset", "debugfs",
+	"devpts", "devtmpfs", "efivarfs", "ecryptfs", "fuse", "fusectl",
+	"hugetlbfs", "mqueue", "ncpfs", "nfs", "nfs4", "nfsd", "nsfs",
+	"pipefs", "proc", "pstore", "ramfs", "rpc_pipefs", "securityfs",
+	"selinuxfs", "smb3", "smbfs", "sockfs", "sshfs", "sysfs", "tmpfs",
+	"tracefs", "usbfs",
+}
+
+// mount is one entry of a mountinfo file.
+type mount struct {
+	point  string // where it is mounted
+	root   string // the directory of the source filesystem mounted there
+	dev    string // major:minor of the source filesystem
+	fsType string
+}
+
+// readMounts parses a mountinfo file (see proc(5)).
+func readMounts(path string) ([]mount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mount
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		// The optional fields before "-" vary in number.
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("parse %s: malformed line %q", path, sc.Text())
+		}
+		mounts = append(mounts, mount{
+			point:  unescapeMount(fields[4]),
+			root:   unescapeMount(fields[3]),
+			dev:    fields[2],
+			fsType: fields[sep+1],
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return mounts, nil
+}
+
+// unescapeMount decodes the octal escapes (\040 for a space, \011, \012 and
+// \134) the kernel uses for whitespace and backslashes in mountinfo paths.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// prunedMounts returns the mount points, read from the mountinfo file at path,
+// whose filesystem type is in types or, if bindMounts is set, that are bind
+// mounts. A type matches both itself and its subtypes, so "fuse" covers
+// "fuse.sshfs". A missing mountinfo file (a system without /proc) yields no
+// mount points rather than an error.
+func prunedMounts(path string, types []string, bindMounts bool) (map[string]struct{}, error) {
+	if len(types) == 0 && !bindMounts {
+		return nil, nil
+	}
+	mounts, err := readMounts(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prune := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		prune[strings.ToLower(t)] = struct{}{}
+	}
+	points := make(map[string]struct{})
+	for i, m := range mounts {
+		if bindMounts && isBindMount(mounts[:i], m) {
+			points[m.point] = struct{}{}
+			continue
+		}
+		t := strings.ToLower(m.fsType)
+		base, _, _ := strings.Cut(t, ".")
+		_, full := prune[t]
+		_, parent := prune[base]
+		if full || parent {
+			points[m.point] = struct{}{}
+		}
+	}
+	return points, nil
+}
+
+// isBindMount reports whether m re-mounts a directory that one of the earlier
+// mounts already makes visible: the same device, with m's root at or below
+// the earlier mount's root. Comparing roots rather than only devices keeps
+// btrfs subvolumes, which share a device but not a root, from counting.
+func isBindMount(earlier []mount, m mount) bool {
+	for _, e := range earlier {
+		if e.dev == m.dev && within(m.root, e.root) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const fakeMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:22 / /proc rw,nosuid - proc proc rw
+24 22 0:24 / /home/me/My\040Drive rw shared:7 master:2 - fuse.sshfs me@host: rw
+25 22 8:1 /srv/data /data rw - ext4 /dev/sda1 rw
+`
+
+func writeMountInfo(t *testing.T, content string) string {
+	t.Helper()
+	return writeFile(t, t.TempDir(), "mountinfo", content)
+}
+
+func TestReadMounts(t *testing.T) {
+	mounts, err := readMounts(writeMountInfo(t, fakeMountInfo))
+	if err != nil {
+		t.Fatalf("readMounts: %v", err)
+	}
+	want := []mount{
+		{"/", "/", "8:1", "ext4"},
+		{"/proc", "/", "0:22", "proc"},
+		{"/home/me/My Drive", "/", "0:24", "fuse.sshfs"},
+		{"/data", "/srv/data", "8:1", "ext4"},
+	}
+	if len(mounts) != len(want) {
+		t.Fatalf("got %d mounts, want %d: %+v", len(mounts), len(want), mounts)
+	}
+	for i := range want {
+		if mounts[i] != want[i] {
+			t.Errorf("mount %d = %+v, want %+v", i, mounts[i], want[i])
+		}
+	}
+}
+
+func TestReadMountsMalformed(t *testing.T) {
+	if _, err := readMounts(writeMountInfo(t, "22 1 8:1 / /\n")); err == nil {
+		t.Fatal("readMounts accepted a line without a fs type")
+	}
+}
+
+func TestPrunedMounts(t *testing.T) {
+	points, err := prunedMounts(writeMountInfo(t, fakeMountInfo), []string{"PROC", "fuse"}, false)
+	if err != nil {
+		t.Fatalf("prunedMounts: %v", err)
+	}
+	for _, p := range []string{"/proc", "/home/me/My Drive"} {
+		if _, ok := points[p]; !ok {
+			t.Errorf("%s not pruned", p)
+		}
+	}
+	if len(points) != 2 {
+		t.Errorf("pruned %v, want /proc and the sshfs mount only", points)
+	}
+
+	// Without a mount table there is nothing to prune.
+	points, err = prunedMounts(filepath.Join(t.TempDir(), "missing"), DefaultPruneFS, true)
+	if err != nil || len(points) != 0 {
+		t.Fatalf("prunedMounts(missing) = %v, %v; want none", points, err)
+	}
+}
+
+func TestPrunedBindMounts(t *testing.T) {
+	info := writeMountInfo(t, fakeMountInfo+`26 22 0:30 /@ /mnt/pool rw - btrfs /dev/sdb rw
+27 22 0:30 /@home /mnt/home rw - btrfs /dev/sdb rw
+28 22 0:30 /@/backups /backups rw - btrfs /dev/sdb rw
+`)
+	points, err := prunedMounts(info, nil, true)
+	if err != nil {
+		t.Fatalf("prunedMounts: %v", err)
+	}
+	// /data re-mounts /srv/data from the root filesystem and /backups a
+	// directory of /mnt/pool; /mnt/home is a separate btrfs subvolume.
+	if len(points) != 2 {
+		t.Fatalf("pruned %v, want /data and /backups", points)
+	}
+	for _, p := range []string{"/data", "/backups"} {
+		if _, ok := points[p]; !ok {
+			t.Errorf("bind mount %s not pruned", p)
+		}
+	}
+}
+
+func TestRunPrunesFilesystemTypes(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	info := writeMountInfo(t, "30 1 0:40 / "+filepath.Join(root, "sub")+" rw - tmpfs tmpfs rw\n")
+
+	if _, err := Run(t.Context(), s, root, Options{PruneFS: []string{"tmpfs"}, MountInfo: info}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	for _, p := range indexed(t, s, root) {
+		if p == "sub" || p == "sub/f3.txt" {
+			t.Fatalf("row %q on a pruned filesystem was indexed", p)
+		}
+	}
+}
+
+func TestOneFilesystem(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	// Everything in a plain tree shares root's device.
+	if _, err := Run(t.Context(), s, root, Options{OneFilesystem: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := indexed(t, s, root); len(got) != 6 {
+		t.Fatalf("indexed %q, want the whole tree", got)
+	}
+
+	// /proc is a mount point on any Linux system: walking / must stop there.
+	proc, err := os.Lstat("/proc")
+	if err != nil {
+		t.Skip("no /proc")
+	}
+	rootInfo, err := os.Lstat("/")
+	if err != nil || device(rootInfo) == 0 || device(rootInfo) == device(proc) {
+		t.Skip("/proc is not a separate device here")
+	}
+	f, err := newFilter("/", Options{OneFilesystem: true})
+	if err != nil {
+		t.Fatalf("newFilter: %v", err)
+	}
+	if !f.skip("/proc", proc) {
+		t.Fatal("-xdev walk would descend into /proc")
+	}
+}
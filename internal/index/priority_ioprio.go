@@ -0,0 +1,46 @@
+//go:build linux
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set(2) arguments, which x/sys/unix does not define.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// IdlePriority lowers the CPU priority of the process to the lowest (nice 19)
+// and puts its I/O in the idle class, so its reads are served only when no
+// other process wants the disk, as with ionice -c3. On Linux both are set per
+// thread, so it sets them on every thread the process has; threads started
+// later inherit them.
+func IdlePriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("list threads: %w", err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		// A thread may exit while this runs.
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, 19); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("set nice of thread %d: %w", tid, err)
+		}
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 && errno != unix.ESRCH {
+			return fmt.Errorf("set I/O priority of thread %d: %w", tid, errno)
+		}
+	}
+	return nil
+}
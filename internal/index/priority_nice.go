@@ -0,0 +1,19 @@
+//go:build unix && !linux
+
+package index
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// IdlePriority lowers the CPU priority of the process to the lowest (nice
+// 19). This platform has no I/O priority to set, but the process's reads
+// are then issued less often when others compete for the CPU.
+func IdlePriority() error {
+	if err := unix.Setpriority(unix.PRIO_PROCESS, 0, 19); err != nil {
+		return fmt.Errorf("set nice: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package index
+
+import "errors"
+
+// IdlePriority is not supported on this platform.
+func IdlePriority() error {
+	return errors.New("idle priority is not supported on this platform")
+}
@@ -0,0 +1,73 @@
+package index
+
+import "time"
+
+// DefaultProgressInterval is how often Options.Progress is called when
+// Options.ProgressInterval is not set.
+const DefaultProgressInterval = time.Second
+
+// Progress is a snapshot of how far an indexing run has got, passed to
+// Options.Progress. The counts include entries that a resumed run only walks.
+type Progress struct {
+	Dirs        int64         // directories walked
+	Files       int64         // other entries walked
+	Hashed      int64         // files hashed
+	HashedBytes int64         // the size of the files hashed
+	Elapsed     time.Duration // since the run started
+	Path        string        // the last path walked
+	Done        bool          // set on the last report, made once the run has ended
+}
+
+// BytesPerSec returns the average hashing throughput of the run so far.
+func (p Progress) BytesPerSec() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.HashedBytes) / p.Elapsed.Seconds()
+}
+
+// progress returns a snapshot of c, for a run that started at start.
+func (c *counts) progress(start time.Time) Progress {
+	return Progress{
+		Dirs:        c.dirs.Load(),
+		Files:       c.files.Load(),
+		Hashed:      c.hashed.Load(),
+		HashedBytes: c.hashedBytes.Load(),
+		Elapsed:     time.Since(start),
+		Path:        c.lastPath(),
+	}
+}
+
+// reportProgress calls fn with c's progress every interval, from a goroutine
+// of its own, until the returned function is called. That waits for the
+// goroutine, then makes a last report with Done set. A nil fn reports nothing.
+func (c *counts) reportProgress(fn func(Progress), interval time.Duration) (stop func()) {
+	if fn == nil {
+		return func() {}
+	}
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	start := time.Now()
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+				fn(c.progress(start))
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+		p := c.progress(start)
+		p.Done = true
+		fn(p)
+	}
+}
@@ -0,0 +1,49 @@
+package index
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunReportsProgress(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+
+	var reports []Progress
+	opts := Options{Hash: true, ProgressInterval: time.Millisecond, Progress: func(p Progress) {
+		reports = append(reports, p)
+	}}
+	if _, err := Run(t.Context(), s, root, opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(reports) == 0 {
+		t.Fatal("Run made no progress reports")
+	}
+	for i, p := range reports[1:] {
+		if prev := reports[i]; p.Files < prev.Files || p.Hashed < prev.Hashed || p.Elapsed < prev.Elapsed {
+			t.Fatalf("progress went backwards: %+v then %+v", prev, p)
+		}
+	}
+
+	// root and sub; f1, f2, f3 and link, of which the three files are hashed.
+	last := reports[len(reports)-1]
+	size := int64(len("duplicate content")*2 + len("unique content"))
+	if !last.Done || last.Dirs != 2 || last.Files != 4 || last.Hashed != 3 || last.HashedBytes != size || last.Path == "" {
+		t.Fatalf("last report = %+v", last)
+	}
+	for _, p := range reports[:len(reports)-1] {
+		if p.Done {
+			t.Fatalf("report before the last is done: %+v", p)
+		}
+	}
+}
+
+func TestProgressBytesPerSec(t *testing.T) {
+	p := Progress{HashedBytes: 3 << 20, Elapsed: 2 * time.Second}
+	if got := p.BytesPerSec(); got != 1.5*(1<<20) {
+		t.Fatalf("BytesPerSec = %v, want 1.5 MiB/s", got)
+	}
+	if got := (Progress{HashedBytes: 1}).BytesPerSec(); got != 0 {
+		t.Fatalf("BytesPerSec with no time elapsed = %v, want 0", got)
+	}
+}
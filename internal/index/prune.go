@@ -0,0 +1,127 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// Prune removes rows under root for files that no longer exist on disk, or
+// that opts now excludes. It walks the tree without hashing or writing any new
+// rows (the -prune mode); only the exclusion fields of opts are used. If ctx
+// is cancelled the walk stops and nothing is pruned.
+func Prune(ctx context.Context, s *store.Store, root string, opts Options) error {
+	f, err := newFilter(root, opts)
+	if err != nil {
+		return err
+	}
+	w := newWalkState()
+	if err := walk(ctx, root, f, w, func(string, fs.FileInfo) {}); err != nil {
+		return fmt.Errorf("walk %q: %w", root, err)
+	}
+	return prune(s, root, w)
+}
+
+// walk walks root, skipping what f excludes (excluded directories are not
+// entered at all), recording what it sees and fails on in w, and calling fn
+// for every entry it keeps. It stops with ctx's error once ctx is cancelled.
+func walk(ctx context.Context, root string, f *filter, w *walkState, fn func(path string, info fs.FileInfo)) error {
+	return filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Check exclusions first: an unreadable directory that is excluded
+		// anyway is skipped, not recorded as a failure.
+		if info != nil && f.skip(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			w.fail(path, err)
+			return nil // skip this entry, keep walking
+		}
+		w.see(path)
+		fn(path, info)
+		return nil
+	})
+}
+
+// walkState records which paths a walk visited and which it failed to read.
+// It is only touched from the walk goroutine, so it needs no locking.
+type walkState struct {
+	seen   map[string]struct{}
+	failed []string
+	onFail func(path string, err error) // if not nil, called on each failure
+}
+
+func newWalkState() *walkState {
+	return &walkState{seen: make(map[string]struct{})}
+}
+
+func (w *walkState) see(path string) {
+	w.seen[path] = struct{}{}
+}
+
+// fail records a path the walk could not stat or read. Everything at or below
+// it is treated as unknown rather than deleted, so a permission-denied or
+// briefly unreadable subtree never has its rows wiped.
+func (w *walkState) fail(path string, err error) {
+	log.Error().Err(err).Str("path", path).Msg("walk error")
+	w.failed = append(w.failed, path)
+	if w.onFail != nil {
+		w.onFail(path, err)
+	}
+}
+
+// prune deletes the rows under root that the walk did not see, keeping any
+// row at or below a path the walk failed on.
+func prune(s *store.Store, root string, w *walkState) error {
+	paths, err := s.Paths(root)
+	if err != nil {
+		return err
+	}
+
+	var gone []string
+	for _, path := range paths {
+		if _, ok := w.seen[path]; ok {
+			continue
+		}
+		if withinAny(path, w.failed) {
+			continue
+		}
+		gone = append(gone, path)
+	}
+
+	if err := s.Delete(gone); err != nil {
+		return fmt.Errorf("prune %q: %w", root, err)
+	}
+	log.Debug().Int("rows", len(gone)).Str("root", root).Msg("pruned deleted files")
+	return nil
+}
+
+// withinAny reports whether path is one of dirs or lies below one of them.
+func withinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if within(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether path is dir or lies below it.
+func within(path, dir string) bool {
+	if path == dir {
+		return true
+	}
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	return strings.HasPrefix(path, prefix)
+}
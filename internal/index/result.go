@@ -0,0 +1,120 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// ErrorKind classifies the errors that keep a path from being indexed.
+type ErrorKind string
+
+const (
+	// ErrPermission: the path could not be read for lack of permission
+	// (EACCES, EPERM).
+	ErrPermission ErrorKind = "permission"
+	// ErrVanished: the path was removed between the walk listing it and it
+	// being read (ENOENT).
+	ErrVanished ErrorKind = "vanished"
+	// ErrIO: any other error reading the path.
+	ErrIO ErrorKind = "io"
+	// ErrStore: the path's row could not be written.
+	ErrStore ErrorKind = "store"
+)
+
+// errorSamples is how many errors of each kind a Result keeps.
+const errorSamples = 10
+
+// ErrTooManyErrors is returned by Run when it stopped because paths failed
+// more often than Options.MaxErrors allows.
+var ErrTooManyErrors = errors.New("too many errors")
+
+// PathError is an error that kept Path from being indexed, or its row from
+// being updated.
+type PathError struct {
+	Path string
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *PathError) Error() string { return fmt.Sprintf("%s: %s: %v", e.Kind, e.Path, e.Err) }
+
+func (e *PathError) Unwrap() error { return e.Err }
+
+// kindOf classifies err, an error reading the file system.
+func kindOf(err error) ErrorKind {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return ErrPermission
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrVanished
+	default:
+		return ErrIO
+	}
+}
+
+// Result describes what an indexing run did. Paths that failed do not make
+// Run fail; they are counted and sampled here.
+type Result struct {
+	// Run is the run's record, with its ID, status and counts.
+	Run store.Run
+	// Errors counts the paths that failed, by kind, and Samples holds the
+	// first few errors of each kind.
+	Errors  map[ErrorKind]int64
+	Samples map[ErrorKind][]*PathError
+}
+
+// Failed returns how many paths failed.
+func (r *Result) Failed() int64 {
+	var n int64
+	for _, count := range r.Errors {
+		n += count
+	}
+	return n
+}
+
+// errorLog collects the errors of a run for its Result, and stops the run
+// once it holds max of them. The hashing workers add to it concurrently.
+type errorLog struct {
+	max  int               // errors that stop the run; 0 for no limit
+	stop func(cause error) // cancels the run
+
+	mu      sync.Mutex
+	total   int
+	first   *PathError
+	counts  map[ErrorKind]int64
+	samples map[ErrorKind][]*PathError
+}
+
+// add records that path failed with err.
+func (l *errorLog) add(path string, kind ErrorKind, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts == nil {
+		l.counts = make(map[ErrorKind]int64)
+		l.samples = make(map[ErrorKind][]*PathError)
+	}
+	e := &PathError{path, kind, err}
+	if l.first == nil {
+		l.first = e
+	}
+	l.total++
+	l.counts[kind]++
+	if len(l.samples[kind]) < errorSamples {
+		l.samples[kind] = append(l.samples[kind], e)
+	}
+	if l.max > 0 && l.total == l.max && l.stop != nil {
+		l.stop(fmt.Errorf("%w: stopped after %d, the first %w", ErrTooManyErrors, l.total, l.first))
+	}
+}
+
+// result copies the errors into r.
+func (l *errorLog) result(r *Result) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.Errors, r.Samples = l.counts, l.samples
+}
@@ -0,0 +1,124 @@
+package index
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// failHasher hashes like xxh3, but fails on content starting with "bad".
+type failHasher struct{}
+
+func (failHasher) Name() string { return "fail-test" }
+
+func (failHasher) Hash(r io.Reader) (string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(string(b), "bad") {
+		return "", errors.New("unreadable sector")
+	}
+	return xxh3Hasher{}.Hash(bytes.NewReader(b))
+}
+
+// buildBadTree creates good.txt and the files bad1 to bad3, which failHasher
+// cannot hash.
+func buildBadTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeFile(t, root, "good.txt", "good")
+	for _, name := range []string{"bad1", "bad2", "bad3"} {
+		writeFile(t, root, name, "bad "+name)
+	}
+	return root
+}
+
+func TestRunResultCountsErrors(t *testing.T) {
+	Register(failHasher{})
+	s := openStore(t)
+	root := buildBadTree(t)
+
+	res, err := Run(t.Context(), s, root, Options{Hash: true, HashAlgo: "fail-test"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Failed() != 3 || res.Errors[ErrIO] != 3 || len(res.Samples[ErrIO]) != 3 {
+		t.Fatalf("Result errors = %v, %v; want 3 I/O errors", res.Errors, res.Samples)
+	}
+	e := res.Samples[ErrIO][0]
+	if !strings.HasPrefix(filepath.Base(e.Path), "bad") || !strings.Contains(e.Error(), "unreadable sector") {
+		t.Fatalf("sample error = %v", e)
+	}
+	if res.Run.ID == 0 || res.Run.Status != store.RunDone || res.Run.Errors != 3 || res.Run.Hashed != 1 {
+		t.Fatalf("Result run = %+v", res.Run)
+	}
+	// Files that could not be hashed are still recorded, without a digest.
+	if fi := lookup(t, s, filepath.Join(root, "bad1")); fi.Hash != "" {
+		t.Fatalf("bad1 recorded with digest %q", fi.Hash)
+	}
+}
+
+func TestRunMaxErrors(t *testing.T) {
+	Register(failHasher{})
+	for _, opts := range []Options{{MaxErrors: 2}, {FailFast: true}} {
+		s := openStore(t)
+		root := buildBadTree(t)
+		writeFile(t, root, "gone.txt", "gone")
+		if _, err := Run(t.Context(), s, root, Options{}); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if err := os.Remove(filepath.Join(root, "gone.txt")); err != nil {
+			t.Fatalf("remove: %v", err)
+		}
+
+		opts.Hash, opts.Rehash, opts.HashAlgo, opts.Workers = true, true, "fail-test", 1
+		want := int64(max(opts.MaxErrors, 1))
+		res, err := Run(t.Context(), s, root, opts)
+		var pe *PathError
+		if !errors.Is(err, ErrTooManyErrors) || !errors.As(err, &pe) || pe.Kind != ErrIO {
+			t.Fatalf("Run with %+v = %v, want ErrTooManyErrors with the first error", opts, err)
+		}
+		if res.Failed() != want || res.Run.Status != store.RunFailed {
+			t.Fatalf("Run with %+v: %d errors, status %s; want %d, failed", opts, res.Failed(), res.Run.Status, want)
+		}
+		// The run stopped before it could prune.
+		lookup(t, s, filepath.Join(root, "gone.txt"))
+	}
+}
+
+func TestPipelineStoreFailureMidBatch(t *testing.T) {
+	s := openStore(t)
+	c := new(counts)
+	p := newPipeline(t.Context(), s, Options{BatchSize: 100}, c, 0)
+
+	// A zone offset the database cannot store makes /bad's insert fail.
+	bad := time.Unix(1, 0).In(time.FixedZone("bad", 1<<30))
+	for _, fi := range []store.FileInfo{
+		{Path: "/a", ModTime: time.Unix(1, 0)},
+		{Path: "/b", ModTime: time.Unix(1, 0)},
+		{Path: "/bad", ModTime: bad},
+		{Path: "/c", ModTime: time.Unix(1, 0)},
+	} {
+		p.put(fi, 0)
+	}
+	if err := p.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	var res Result
+	c.errs.result(&res)
+	if res.Errors[ErrStore] != 1 || res.Samples[ErrStore][0].Path != "/bad" || c.inserted.Load() != 3 {
+		t.Fatalf("errors %v, inserted %d; want /bad failed and 3 rows inserted", res.Samples, c.inserted.Load())
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		lookup(t, s, path)
+	}
+}
@@ -0,0 +1,250 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// scrubResumeKey is the meta key holding the path an unfinished scrub stopped
+// after, or "" once a pass has completed.
+const scrubResumeKey = "scrub.resume"
+
+// defaultScrubPage is how many rows Scrub reads from the store at a time.
+const defaultScrubPage = 1000
+
+// ScrubStatus is what Scrub found for one file.
+type ScrubStatus string
+
+const (
+	// ScrubOK: the content still has the recorded digest.
+	ScrubOK ScrubStatus = "ok"
+	// ScrubCorrupt: the content no longer has the recorded digest, although
+	// the size, mtime and inode are unchanged. Nothing that edits a file
+	// normally does that, so it is silent corruption. The row keeps the old
+	// digest, so the file is reported again until it is restored or
+	// re-indexed with -rehash.
+	ScrubCorrupt ScrubStatus = "corrupt"
+	// ScrubChanged: the file was modified since it was indexed, and its row
+	// has been updated as an indexing run would.
+	ScrubChanged ScrubStatus = "changed"
+	// ScrubMissing: the file is gone. Its row is left for the next prune.
+	ScrubMissing ScrubStatus = "missing"
+	// ScrubError: the file could not be read.
+	ScrubError ScrubStatus = "error"
+)
+
+// ScrubEvent reports one file checked by Scrub. It is meant to be written out
+// as a line of JSON.
+type ScrubEvent struct {
+	Path     string      `json:"path"`
+	Status   ScrubStatus `json:"status"`
+	Size     int64       `json:"size"`
+	ModTime  time.Time   `json:"mtime"`
+	Algo     string      `json:"algo,omitempty"`
+	Expected string      `json:"expected,omitempty"` // the recorded digest
+	Actual   string      `json:"actual,omitempty"`   // the digest read now
+	Error    string      `json:"error,omitempty"`
+}
+
+// ScrubStats counts what a Scrub run checked.
+type ScrubStats struct {
+	Files   int64 `json:"files"`
+	Bytes   int64 `json:"bytes"`
+	OK      int64 `json:"ok"`
+	Corrupt int64 `json:"corrupt"`
+	Changed int64 `json:"changed"`
+	Missing int64 `json:"missing"`
+	Errors  int64 `json:"errors"`
+	// Skipped counts rows with no digest to check: non-regular files,
+	// zero-byte files and files indexed without hashing.
+	Skipped int64 `json:"skipped"`
+	// Done is set once the pass reached the end of the table. Otherwise the
+	// next Scrub resumes where this one stopped.
+	Done bool `json:"done"`
+}
+
+// ScrubOptions controls a Scrub run.
+type ScrubOptions struct {
+	// BytesPerSec caps how fast files are read, so a scrub does not starve
+	// other users of the disk. 0 means no limit.
+	BytesPerSec int64
+	// Duration stops the run once it has taken this long, leaving the rest
+	// of the table for the next run. 0 means no limit.
+	Duration time.Duration
+	// Restart ignores where an earlier unfinished run stopped and starts
+	// again from the first row.
+	Restart bool
+	// PageSize is how many rows are read from the store at a time; values
+	// <= 0 select a default.
+	PageSize int
+}
+
+// Scrub reads back this host's hashed rows, in path order, hashes each file
+// again with the algorithm of its recorded digest, and calls report with what
+// it found (see ScrubStatus). Files edited since they were indexed have their
+// rows updated; corrupt files keep theirs.
+//
+// Scrub records its progress in the store after every page of rows, so a run
+// that is stopped, by opts.Duration or otherwise, is picked up where it left
+// off by the next one. A pass that reaches the end clears the resume point,
+// and the run after it starts over. An error from report, or ctx being
+// cancelled, stops the run with that error once its progress is saved.
+func Scrub(ctx context.Context, s *store.Store, opts ScrubOptions, report func(ScrubEvent) error) (ScrubStats, error) {
+	var st ScrubStats
+	after := ""
+	if !opts.Restart {
+		var err error
+		if after, _, err = s.Meta(scrubResumeKey); err != nil {
+			return st, err
+		}
+		if after != "" {
+			log.Info().Str("after", after).Msg("resuming scrub")
+		}
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultScrubPage
+	}
+
+	start := time.Now()
+	lim := newRateLimiter(opts.BytesPerSec, realClock{})
+	for {
+		page, err := s.FilesAfter(after, pageSize)
+		if err != nil {
+			return st, err
+		}
+		if len(page) == 0 {
+			st.Done = true
+			return st, s.SetMeta(scrubResumeKey, "")
+		}
+
+		var changed []store.FileInfo
+		stop := false
+		for _, fi := range page {
+			if opts.Duration > 0 && time.Since(start) >= opts.Duration {
+				stop = true
+				break
+			}
+			ev, update, ok := scrubFile(ctx, fi, lim)
+			if err = ctx.Err(); err != nil {
+				stop = true // fi was abandoned part-way
+				break
+			}
+			if !ok {
+				st.Skipped++
+				after = fi.Path
+				continue
+			}
+			st.count(ev)
+			if update != nil {
+				changed = append(changed, *update)
+			}
+			if err = report(ev); err != nil {
+				stop = true
+				break
+			}
+			after = fi.Path
+		}
+		if serr := saveScrub(s, changed, after); serr != nil {
+			return st, serr
+		}
+		if stop {
+			return st, err
+		}
+	}
+}
+
+// scrubFile checks one row. It returns ok false for rows without a digest to
+// check, and the updated row for a file that was edited. Its reads are paced
+// by lim.
+func scrubFile(ctx context.Context, fi store.FileInfo, lim *rateLimiter) (ev ScrubEvent, update *store.FileInfo, ok bool) {
+	if fi.Type != store.TypeFile || fi.Size == 0 || fi.Hash == "" {
+		return ev, nil, false
+	}
+	ev = ScrubEvent{Path: fi.Path, Size: fi.Size, ModTime: fi.ModTime, Algo: fi.HashAlgo, Expected: fi.Hash}
+
+	full, err := LookupHasher(fi.HashAlgo)
+	if err != nil {
+		ev.Status, ev.Error = ScrubError, err.Error()
+		return ev, nil, true
+	}
+	imo, digest, info, err := hashPath(ctx, fi.Path, true, full, lim)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		ev.Status = ScrubMissing
+		return ev, nil, true
+	case err != nil:
+		ev.Status, ev.Error = ScrubError, err.Error()
+		return ev, nil, true
+	}
+	ev.Actual = digest
+
+	now := store.FileInfo{
+		Path:    fi.Path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Type:    store.TypeOf(info.Mode()),
+		Mode:    info.Mode(),
+	}
+	fillStat(&now, info)
+	switch {
+	case !now.Unchanged(fi):
+		ev.Status = ScrubChanged
+		ev.Size, ev.ModTime = now.Size, now.ModTime
+		now.Imohash, now.Hash, now.HashAlgo = imo, digest, full.Name()
+		return ev, &now, true
+	case digest != fi.Hash:
+		ev.Status = ScrubCorrupt
+	default:
+		ev.Status = ScrubOK
+	}
+	return ev, nil, true
+}
+
+// count adds ev to the stats.
+func (st *ScrubStats) count(ev ScrubEvent) {
+	st.Files++
+	switch ev.Status {
+	case ScrubOK:
+		st.OK++
+	case ScrubCorrupt:
+		st.Corrupt++
+	case ScrubChanged:
+		st.Changed++
+	case ScrubMissing:
+		st.Missing++
+	case ScrubError:
+		st.Errors++
+	}
+	if ev.Status != ScrubMissing && ev.Status != ScrubError {
+		st.Bytes += ev.Size
+	}
+}
+
+// saveScrub writes the rows of edited files, then records after as the point
+// to resume from.
+func saveScrub(s *store.Store, changed []store.FileInfo, after string) error {
+	if len(changed) > 0 {
+		b := s.NewBatch(0, 0)
+		for _, fi := range changed {
+			if err := b.Put(fi, false); err != nil {
+				_ = b.Close()
+				return fmt.Errorf("record changed file: %w", err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			return fmt.Errorf("record changed files: %w", err)
+		}
+		if failed := b.Failed(); len(failed) > 0 {
+			return fmt.Errorf("record changed file %q: %w", failed[0].Path, failed[0].Err)
+		}
+	}
+	return s.SetMeta(scrubResumeKey, after)
+}
@@ -0,0 +1,128 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// scrub runs Scrub and returns the events it reported, by path.
+func scrub(t *testing.T, s *store.Store, opts ScrubOptions) (map[string]ScrubEvent, ScrubStats) {
+	t.Helper()
+	events := make(map[string]ScrubEvent)
+	st, err := Scrub(t.Context(), s, opts, func(ev ScrubEvent) error {
+		events[ev.Path] = ev
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scrub: %v", err)
+	}
+	return events, st
+}
+
+func TestScrub(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	f1 := filepath.Join(root, "f1.txt")
+	f2 := filepath.Join(root, "f2.txt")
+	f3 := filepath.Join(root, "sub", "f3.txt")
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	events, st := scrub(t, s, ScrubOptions{})
+	if !st.Done || st.Files != 3 || st.OK != 3 {
+		t.Fatalf("scrub of an intact tree = %+v, %+v", st, events)
+	}
+
+	// Flip f3's content in place, keeping its size and mtime: bitrot.
+	info, err := os.Stat(f3)
+	if err != nil {
+		t.Fatalf("stat f3: %v", err)
+	}
+	before := lookup(t, s, f3)
+	if err := os.WriteFile(f3, []byte("uniqu3 content"), 0o644); err != nil {
+		t.Fatalf("rewrite f3: %v", err)
+	}
+	if err := os.Chtimes(f3, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("chtimes f3: %v", err)
+	}
+	// Edit f1 the normal way and delete f2.
+	if err := os.WriteFile(f1, []byte("edited"), 0o644); err != nil {
+		t.Fatalf("edit f1: %v", err)
+	}
+	if err := os.Chtimes(f1, time.Now(), time.Unix(1e9, 0)); err != nil {
+		t.Fatalf("chtimes f1: %v", err)
+	}
+	if err := os.Remove(f2); err != nil {
+		t.Fatalf("remove f2: %v", err)
+	}
+
+	events, st = scrub(t, s, ScrubOptions{})
+	if events[f3].Status != ScrubCorrupt || events[f3].Expected == events[f3].Actual ||
+		events[f1].Status != ScrubChanged || events[f2].Status != ScrubMissing {
+		t.Fatalf("scrub events = %+v", events)
+	}
+	if st.Corrupt != 1 || st.Changed != 1 || st.Missing != 1 {
+		t.Fatalf("scrub stats = %+v", st)
+	}
+	if after := lookup(t, s, f3); after.Hash != before.Hash {
+		t.Fatalf("corrupt f3's digest was overwritten: %q -> %q", before.Hash, after.Hash)
+	}
+	if fi := lookup(t, s, f1); fi.Size != int64(len("edited")) || fi.Hash != events[f1].Actual {
+		t.Fatalf("edited f1 not recorded: %+v", fi)
+	}
+
+	// The edit is recorded, so only the corruption is reported again.
+	events, _ = scrub(t, s, ScrubOptions{})
+	if events[f1].Status != ScrubOK || events[f3].Status != ScrubCorrupt {
+		t.Fatalf("second scrub events = %+v", events)
+	}
+}
+
+func TestScrubResumes(t *testing.T) {
+	s := openStore(t)
+	root := buildTree(t)
+	if _, err := Run(t.Context(), s, root, Options{Hash: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// Stop after the first file.
+	errStop := errors.New("stop")
+	var first string
+	st, err := Scrub(t.Context(), s, ScrubOptions{PageSize: 2}, func(ev ScrubEvent) error {
+		first = ev.Path
+		return errStop
+	})
+	if !errors.Is(err, errStop) || st.Done {
+		t.Fatalf("interrupted Scrub = %+v, %v", st, err)
+	}
+
+	// The first file was not reported successfully, so it is checked again;
+	// the resumed run then finishes the pass.
+	events, st := scrub(t, s, ScrubOptions{PageSize: 2})
+	if _, ok := events[first]; !ok || !st.Done || st.Files != 3 {
+		t.Fatalf("resumed scrub = %+v, %+v", st, events)
+	}
+
+	// Stop after the first file again, this time once it was reported.
+	n := 0
+	if _, err := Scrub(t.Context(), s, ScrubOptions{PageSize: 1}, func(ScrubEvent) error {
+		if n++; n > 1 {
+			return errStop
+		}
+		return nil
+	}); !errors.Is(err, errStop) {
+		t.Fatalf("interrupted Scrub: %v", err)
+	}
+	if events, st = scrub(t, s, ScrubOptions{}); st.Files != 2 {
+		t.Fatalf("resumed scrub checked %d files, want 2: %+v", st.Files, events)
+	}
+	if _, st = scrub(t, s, ScrubOptions{Restart: true}); st.Files != 3 {
+		t.Fatalf("restarted scrub checked %d files, want 3", st.Files)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build linux || openbsd || dragonfly || solaris || illumos
+
+package index
+
+import (
+	"syscall"
+	"time"
+)
+
+// ctime returns the inode change time of st.
+func ctime(st *syscall.Stat_t) time.Time {
+	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+}
@@ -0,0 +1,12 @@
+//go:build unix && !(linux || openbsd || dragonfly || solaris || illumos || darwin || freebsd || netbsd)
+
+package index
+
+import (
+	"syscall"
+	"time"
+)
+
+// ctime returns the zero time: this platform's Stat_t is not mapped, so the
+// change time is recorded as unknown.
+func ctime(*syscall.Stat_t) time.Time { return time.Time{} }
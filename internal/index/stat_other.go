@@ -0,0 +1,18 @@
+//go:build !unix
+
+package index
+
+import (
+	"io/fs"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// fillStat does nothing: owners, inodes, devices, link counts and ctimes are
+// not available on this platform, so change detection relies on size and
+// mtime alone.
+func fillStat(*store.FileInfo, fs.FileInfo) {}
+
+// device returns 0: device IDs are not available on this platform, so
+// Options.OneFilesystem has no effect.
+func device(fs.FileInfo) uint64 { return 0 }
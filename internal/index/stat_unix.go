@@ -0,0 +1,32 @@
+//go:build unix
+
+package index
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// fillStat copies the platform stat fields of a walked entry into fi.
+func fillStat(fi *store.FileInfo, info fs.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	fi.UID, fi.GID = st.Uid, st.Gid
+	fi.Inode = uint64(st.Ino)
+	fi.Device = uint64(st.Dev)
+	fi.Nlink = uint64(st.Nlink)
+	fi.ChangeTime = ctime(st)
+}
+
+// device returns the ID of the device holding a walked entry, or 0 if it is
+// unavailable.
+func device(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+package index
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// clock is the time source of a rateLimiter; tests replace it.
+type clock interface {
+	Now() time.Time
+	// Sleep waits for d, or returns ctx's error if ctx is cancelled first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// rateLimiter caps how fast files are read, in bytes per second, across all
+// the goroutines sharing it. It is a token bucket holding up to a second's
+// worth of bytes: reads take from it, and a read that finds it short is let
+// through but makes its reader, and then later readers, wait for the bucket
+// to refill. A nil rateLimiter does not limit anything.
+type rateLimiter struct {
+	rate  float64 // bytes per second
+	clock clock
+
+	mu     sync.Mutex
+	tokens float64 // bytes that may be read now; negative when in debt
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing bytesPerSec, or nil if
+// bytesPerSec is not positive.
+func newRateLimiter(bytesPerSec int64, c clock) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSec), clock: c, tokens: float64(bytesPerSec), last: c.Now()}
+}
+
+// wait accounts for n bytes read and sleeps until the rate allows them. It
+// returns ctx's error if ctx is cancelled while it sleeps.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := l.clock.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt >= 0 {
+		return nil
+	}
+	return l.clock.Sleep(ctx, time.Duration(-debt/l.rate*float64(time.Second)))
+}
@@ -0,0 +1,257 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iggy/gocate/internal/store"
+)
+
+// fakeClock is a clock whose Sleep returns at once, moving the time on by
+// what it was asked to wait and adding that to slept.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.now = c.now.Add(d)
+	c.slept += d
+	return ctx.Err()
+}
+
+func TestRateLimiter(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	lim := newRateLimiter(1000, c)
+
+	// The first second's worth is free; every later one is waited for.
+	for range 5 {
+		if err := lim.wait(t.Context(), 1000); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	if c.slept != 4*time.Second {
+		t.Fatalf("slept %v reading 5000 bytes at 1000 B/s, want 4s", c.slept)
+	}
+
+	// Time spent not reading refills the bucket, but no further than a
+	// second's worth.
+	c.now, c.slept = c.now.Add(10*time.Second), 0
+	if err := lim.wait(t.Context(), 3000); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if c.slept != 2*time.Second {
+		t.Fatalf("slept %v reading 3000 bytes after a pause, want 2s", c.slept)
+	}
+	c.now, c.slept = c.now.Add(500*time.Millisecond), 0
+	if err := lim.wait(t.Context(), 400); err != nil || c.slept != 0 {
+		t.Fatalf("wait within the refilled rate slept %v, %v", c.slept, err)
+	}
+
+	var none *rateLimiter
+	if err := none.wait(t.Context(), 1<<30); err != nil {
+		t.Fatalf("nil limiter wait: %v", err)
+	}
+	if newRateLimiter(0, c) != nil {
+		t.Fatal("newRateLimiter(0) limits")
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	lim := newRateLimiter(1, realClock{})
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := lim.wait(ctx, 1000); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait with a cancelled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestHashPathRateLimited(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "f", strings.Repeat("x", 5000))
+	path := filepath.Join(dir, "f")
+	c := &fakeClock{now: time.Unix(0, 0)}
+
+	_, digest, _, err := hashPath(t.Context(), path, true, xxh3Hasher{}, newRateLimiter(1000, c))
+	if err != nil {
+		t.Fatalf("hashPath: %v", err)
+	}
+	if _, want, _ := hashFile(path); digest != want {
+		t.Fatalf("rate limited digest = %q, want %q", digest, want)
+	}
+	if c.slept != 4*time.Second {
+		t.Fatalf("slept %v hashing 5000 bytes at 1000 B/s, want 4s", c.slept)
+	}
+}
+
+// busyHasher hashes like xxh3, slowly, recording how many files it was
+// hashing at once at most.
+type busyHasher struct {
+	mu       sync.Mutex
+	busy     int
+	mostBusy int
+}
+
+func (h *busyHasher) Name() string { return "busy-test" }
+
+func (h *busyHasher) Hash(r io.Reader) (string, error) {
+	h.mu.Lock()
+	h.busy++
+	h.mostBusy = max(h.mostBusy, h.busy)
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.busy--
+		h.mu.Unlock()
+	}()
+	time.Sleep(5 * time.Millisecond)
+	return xxh3Hasher{}.Hash(r)
+}
+
+func TestRunDeviceWorkers(t *testing.T) {
+	s := openStore(t)
+	root := buildDirs(t) // one device
+	h := &busyHasher{}
+	Register(h)
+
+	if _, err := Run(t.Context(), s, root, Options{Hash: true, HashAlgo: h.Name(), Workers: 4, DeviceWorkers: 1}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if h.mostBusy != 1 {
+		t.Fatalf("hashed %d files on one device at once, want 1", h.mostBusy)
+	}
+	if fi := lookup(t, s, filepath.Join(root, "d", "3")); fi.Hash == "" {
+		t.Fatalf("row not hashed: %+v", fi)
+	}
+}
+
+func TestPipelineDeviceWorkers(t *testing.T) {
+	s := openStore(t)
+	p := newPipeline(t.Context(), s, Options{Workers: 4, DeviceWorkers: 1}, new(counts), 0)
+
+	// Device 1's first file keeps its only worker busy until released.
+	release, startedB := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	fn := func(fi *store.FileInfo) error {
+		switch fi.Path {
+		case "/a/1":
+			<-release
+		case "/b/1":
+			close(startedB)
+		}
+		mu.Lock()
+		order = append(order, fi.Path)
+		mu.Unlock()
+		return nil
+	}
+	// The walk goroutine.
+	walked := make(chan struct{})
+	go func() {
+		defer close(walked)
+		for _, fi := range []store.FileInfo{
+			{Path: "/a/1", Device: 1},
+			{Path: "/a/2", Device: 1},
+			{Path: "/a/3", Device: 1},
+			{Path: "/b/1", Device: 2},
+		} {
+			fi.ModTime = time.Unix(1, 0)
+			p.hash(fi, 0, fn)
+		}
+	}()
+
+	select {
+	case <-startedB:
+	case <-time.After(5 * time.Second):
+		t.Error("device 2's file was not hashed while device 1 was busy")
+	}
+	mu.Lock()
+	if slices.ContainsFunc(order, func(path string) bool { return strings.HasPrefix(path, "/a/") }) {
+		t.Errorf("hashed %v while device 1's worker was busy, want none of device 1's files", order)
+	}
+	mu.Unlock()
+
+	close(release)
+	<-walked
+	if err := p.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// Device 1's files went through its one worker in walk order.
+	var a []string
+	for _, path := range order {
+		if strings.HasPrefix(path, "/a/") {
+			a = append(a, path)
+		}
+	}
+	if want := "[/a/1 /a/2 /a/3]"; fmt.Sprint(a) != want {
+		t.Fatalf("device 1's files hashed in order %v, want %s", a, want)
+	}
+	for _, path := range []string{"/a/1", "/a/2", "/a/3", "/b/1"} {
+		lookup(t, s, path)
+	}
+}
+
+// TestPipelineDeviceQueueBounded checks that with one worker per device, a
+// slow device makes the walk wait once the queue is full, rather than
+// queueing every file in memory.
+func TestPipelineDeviceQueueBounded(t *testing.T) {
+	const workers, files = 2, 1000
+	s := openStore(t)
+	p := newPipeline(t.Context(), s, Options{Workers: workers, DeviceWorkers: 1}, new(counts), 0)
+
+	release := make(chan struct{})
+	fn := func(*store.FileInfo) error {
+		<-release
+		return nil
+	}
+	var walked atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range files {
+			p.hash(store.FileInfo{Path: fmt.Sprintf("/f%04d", i), ModTime: time.Unix(1, 0)}, 0, fn)
+			walked.Add(1)
+		}
+	}()
+
+	// One file is being hashed and the rest can only queue.
+	limit := int64(1 + queuedPerWorker*workers)
+	deadline := time.Now().Add(5 * time.Second)
+	for walked.Load() < limit && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := walked.Load(); n != limit {
+		t.Errorf("walk went past %d files while the device was busy, want %d", n, limit)
+	}
+	p.devMu.Lock()
+	queued := len(p.devs[0].waiting)
+	p.devMu.Unlock()
+	if queued > queuedPerWorker*workers {
+		t.Errorf("%d files queued in memory, want at most %d", queued, queuedPerWorker*workers)
+	}
+
+	close(release)
+	<-done
+	if err := p.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	rows, err := s.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(rows) != files {
+		t.Fatalf("wrote %d rows, want %d", len(rows), files)
+	}
+}
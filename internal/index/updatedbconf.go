@@ -0,0 +1,78 @@
+package index
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultUpdatedbConf is where mlocate and plocate keep their configuration.
+const DefaultUpdatedbConf = "/etc/updatedb.conf"
+
+// UpdatedbConf holds the exclusion settings of an updatedb.conf(5) file.
+type UpdatedbConf struct {
+	PrunePaths      []string
+	PruneNames      []string
+	PruneFS         []string
+	PruneBindMounts bool
+}
+
+// ReadUpdatedbConf parses the updatedb.conf file at path: lines of
+// VAR = "value" with "#" comments, where the list variables hold
+// space-separated values. Variables gocate has no use for are ignored.
+func ReadUpdatedbConf(path string) (UpdatedbConf, error) {
+	var c UpdatedbConf
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return c, fmt.Errorf("%s:%d: expected VAR = \"value\"", path, n)
+		}
+		name = strings.TrimSpace(name)
+		value, err := strconv.Unquote(strings.TrimSpace(value))
+		if err != nil {
+			return c, fmt.Errorf("%s:%d: %s: value must be double-quoted", path, n, name)
+		}
+		switch name {
+		case "PRUNEPATHS":
+			c.PrunePaths = strings.Fields(value)
+		case "PRUNENAMES":
+			c.PruneNames = strings.Fields(value)
+		case "PRUNEFS":
+			c.PruneFS = strings.Fields(value)
+		case "PRUNE_BIND_MOUNTS":
+			switch strings.ToLower(value) {
+			case "1", "yes", "true":
+				c.PruneBindMounts = true
+			case "0", "no", "false", "":
+				c.PruneBindMounts = false
+			default:
+				return c, fmt.Errorf("%s:%d: PRUNE_BIND_MOUNTS: invalid value %q", path, n, value)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return c, fmt.Errorf("read %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Apply adds c's exclusions to opts, on top of any already set.
+func (c UpdatedbConf) Apply(opts *Options) {
+	opts.PrunePaths = append(opts.PrunePaths, c.PrunePaths...)
+	opts.PruneNames = append(opts.PruneNames, c.PruneNames...)
+	opts.PruneFS = append(opts.PruneFS, c.PruneFS...)
+	opts.PruneBindMounts = opts.PruneBindMounts || c.PruneBindMounts
+}
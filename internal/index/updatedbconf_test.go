@@ -0,0 +1,47 @@
+package index
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReadUpdatedbConf(t *testing.T) {
+	c, err := ReadUpdatedbConf(filepath.Join("testdata", "updatedb.conf"))
+	if err != nil {
+		t.Fatalf("ReadUpdatedbConf: %v", err)
+	}
+	if !c.PruneBindMounts {
+		t.Error("PRUNE_BIND_MOUNTS not set")
+	}
+	if len(c.PrunePaths) != 7 || c.PrunePaths[0] != "/tmp" || c.PrunePaths[6] != "/var/lib/schroot" {
+		t.Errorf("PrunePaths = %q", c.PrunePaths)
+	}
+	if len(c.PruneNames) != 2 || c.PruneNames[0] != ".git" || c.PruneNames[1] != "node_modules" {
+		t.Errorf("PruneNames = %q, want the uncommented line", c.PruneNames)
+	}
+	if len(c.PruneFS) != 48 || c.PruneFS[0] != "NFS" {
+		t.Errorf("PruneFS has %d entries starting %q", len(c.PruneFS), c.PruneFS[:1])
+	}
+
+	opts := Options{PruneNames: []string{".hg"}}
+	c.Apply(&opts)
+	if len(opts.PruneNames) != 3 || !opts.PruneBindMounts || len(opts.PrunePaths) != 7 {
+		t.Errorf("Apply did not merge the settings: %+v", opts)
+	}
+}
+
+func TestReadUpdatedbConfErrors(t *testing.T) {
+	for _, content := range []string{
+		"PRUNEPATHS /tmp\n",
+		"PRUNEPATHS=/tmp\n",
+		`PRUNE_BIND_MOUNTS="maybe"` + "\n",
+	} {
+		path := writeFile(t, t.TempDir(), "updatedb.conf", content)
+		if _, err := ReadUpdatedbConf(path); err == nil {
+			t.Errorf("ReadUpdatedbConf accepted %q", content)
+		}
+	}
+	if _, err := ReadUpdatedbConf(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("ReadUpdatedbConf of a missing file succeeded")
+	}
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default batch limits, used when NewBatch is given non-positive values.
+const (
+	DefaultBatchSize     = 1000
+	DefaultBatchInterval = time.Second
+)
+
+// Batch writes rows through a long-lived transaction instead of committing
+// each one, which is what makes a full index run fast: per-row commits are
+// dominated by transaction overhead. The open transaction is committed once it
+// holds size rows, every interval, and on Close.
+//
+// Rows written through a Batch are visible to the Store's other methods
+// straight away (they share one transaction context), but are only durable
+// once committed. A row that fails to write does not cost the others in its
+// transaction: they are written again without it. Rows that are lost all the
+// same, because a commit failed, are reported by Failed. A Batch must not be
+// used concurrently with another Batch on the same Store.
+type Batch struct {
+	s    *Store
+	size int
+
+	// Guarded by s.mu.
+	open     bool         // a transaction is in progress
+	pending  []pendingRow // rows written in the open transaction
+	failed   []RowError   // rows lost since the last call to Failed
+	err      error        // first error from a background commit
+	inserted int64        // rows added through the batch and committed
+	updated  int64        // rows changed through the batch and committed
+
+	// The checkpoint to record with the next commit; see Checkpoint.
+	run        int64
+	checkpoint string
+	dirty      bool // checkpoint has not been recorded yet
+	lost       bool // rows were lost, so checkpoints are no longer recorded
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// pendingRow is a row written in a Batch's open transaction: what was put,
+// and what that did to the table.
+type pendingRow struct {
+	fi    FileInfo
+	quick bool
+	w     write
+}
+
+// RowError is a row that a Batch could not write, and why.
+type RowError struct {
+	Path string
+	Err  error
+}
+
+// NewBatch returns a Batch that commits every size rows or every interval,
+// whichever comes first. Non-positive values select DefaultBatchSize and
+// DefaultBatchInterval. The caller must Close it to commit the final rows.
+func (s *Store) NewBatch(size int, interval time.Duration) *Batch {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultBatchInterval
+	}
+
+	b := &Batch{
+		s:    s,
+		size: size,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go b.tick(interval)
+	return b
+}
+
+// tick commits the open transaction every interval so a slow trickle of rows
+// (e.g. while hashing a few huge files) still reaches disk promptly.
+func (b *Batch) tick(interval time.Duration) {
+	defer close(b.done)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+			b.s.mu.Lock()
+			if err := b.commit(); err != nil && b.err == nil {
+				b.err = err
+			}
+			b.s.mu.Unlock()
+		}
+	}
+}
+
+// Put upserts fi inside the batch's transaction with the same semantics as
+// Store.Upsert, committing if the batch is full. If fi cannot be written, the
+// transaction is rolled back, since the failed statement may have left it
+// partly applied, and the rows written in it before fi are written again;
+// Put returns fi's error. Checkpoints are no longer recorded after that, as
+// they could cover fi.
+func (b *Batch) Put(fi FileInfo, quick bool) error {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	if _, err := b.write([]pendingRow{{fi: fi, quick: quick}}); err != nil {
+		b.dirty, b.lost = false, true
+		if rerr := b.retry(); rerr != nil {
+			return fmt.Errorf("%w (rollback: %v)", err, rerr)
+		}
+		return err
+	}
+	if len(b.pending) >= b.size {
+		if err := b.commit(); err != nil {
+			// fi is reported by the error; only the rows before it are
+			// reported by Failed.
+			b.failed = b.failed[:len(b.failed)-1]
+			return err
+		}
+	}
+	return nil
+}
+
+// write upserts rows in order, beginning a transaction if none is open, and
+// adds them to b.pending. It stops at the first that fails, returning its
+// index and error. Callers must hold s.mu.
+func (b *Batch) write(rows []pendingRow) (int, error) {
+	for i, r := range rows {
+		if !b.open {
+			if err := b.s.begin(); err != nil {
+				return i, err
+			}
+			b.open = true
+		}
+		w, err := b.s.upsert(r.fi, r.quick)
+		if err != nil {
+			return i, err
+		}
+		r.w = w
+		b.pending = append(b.pending, r)
+	}
+	return len(rows), nil
+}
+
+// retry rolls back the open transaction after a row failed to write, and
+// writes its other rows again in a new one. A row that fails this time is
+// dropped, and the rest are tried again without it. Callers must hold s.mu.
+func (b *Batch) retry() error {
+	for b.open {
+		b.open = false
+		if err := b.s.rollback(); err != nil {
+			b.drop(b.pending, err)
+			b.pending = nil
+			return err
+		}
+		rows := b.pending
+		b.pending = nil
+		i, err := b.write(rows)
+		if err == nil {
+			break
+		}
+		b.drop(rows[i:i+1], err)
+		b.pending = append(b.pending, rows[i+1:]...)
+		if !b.open {
+			// The transaction could not even begin: rows[i+1:] are lost too.
+			b.drop(b.pending, err)
+			b.pending = nil
+		}
+	}
+	return nil
+}
+
+// drop records that rows were lost with err. Checkpoints recorded from then on
+// could cover them, so none are. Callers must hold s.mu.
+func (b *Batch) drop(rows []pendingRow, err error) {
+	for _, r := range rows {
+		b.failed = append(b.failed, RowError{r.fi.Path, err})
+	}
+	if len(rows) > 0 {
+		b.dirty, b.lost = false, true
+	}
+}
+
+// Failed returns the rows put successfully that were lost afterwards, because
+// writing them again after another row failed did not work or their commit
+// failed, since the last call to Failed. Errors that Put or Close returned
+// are not included.
+func (b *Batch) Failed() []RowError {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	failed := b.failed
+	b.failed = nil
+	return failed
+}
+
+// Written returns how many rows the batch has added and changed so far, once
+// committed.
+func (b *Batch) Written() (inserted, updated int64) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	return b.inserted, b.updated
+}
+
+// Checkpoint records path as run's Run.Checkpoint with the next commit, so it
+// becomes durable together with the rows written before it. Once a failed
+// transaction has lost rows, checkpoints are no longer recorded: they could
+// cover the lost rows.
+func (b *Batch) Checkpoint(run int64, path string) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	if !b.lost {
+		b.run, b.checkpoint, b.dirty = run, path, true
+	}
+}
+
+// Flush commits any rows written since the last commit.
+func (b *Batch) Flush() error {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	return b.commit()
+}
+
+// Close stops the interval timer and commits any remaining rows. It returns
+// the first error from a background commit, if there was one.
+func (b *Batch) Close() error {
+	close(b.stop)
+	<-b.done
+
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	if err := b.commit(); err != nil {
+		return err
+	}
+	return b.err
+}
+
+// commit commits the open transaction, if any, recording a new checkpoint in
+// it. If that fails, its rows are lost and reported by Failed. Callers must
+// hold s.mu.
+func (b *Batch) commit() error {
+	if !b.open && !b.dirty {
+		return nil
+	}
+	if !b.open {
+		if err := b.s.begin(); err != nil {
+			return err
+		}
+	}
+	rows := b.pending
+	b.open, b.pending = false, nil
+	if b.dirty {
+		b.dirty = false
+		if err := b.s.setCheckpoint(b.run, b.checkpoint); err != nil {
+			_ = b.s.rollback()
+			b.drop(rows, err)
+			b.lost = true
+			return fmt.Errorf("commit batch: %w", err)
+		}
+	}
+	if err := b.s.commit(); err != nil {
+		_ = b.s.rollback()
+		b.drop(rows, err)
+		return fmt.Errorf("commit batch: %w", err)
+	}
+	for _, r := range rows {
+		switch r.w {
+		case inserted:
+			b.inserted++
+		case updated:
+			b.updated++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"fmt"
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestBatchPutAndClose(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Size 2 with 5 rows exercises both the size-triggered commit and the
+	// final commit on Close.
+	b := s.NewBatch(2, time.Hour)
+	for i := range 5 {
+		fi := FileInfo{Path: fmt.Sprintf("/f%d", i), ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "h"}
+		if err := b.Put(fi, false); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close batch: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Reopen to check the rows were committed, not just visible in-transaction.
+	s, err = Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	got, err := s.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(got) != 5 {
+		t.Fatalf("Dump returned %d rows, want 5", len(got))
+	}
+}
+
+func TestBatchUpdatesAndIntervalCommit(t *testing.T) {
+	s := openTest(t)
+
+	if err := s.Upsert(FileInfo{Path: "/f", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "old"}, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	b := s.NewBatch(1000, 10*time.Millisecond)
+	if err := b.Put(FileInfo{Path: "/f", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "new"}, false); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The interval commit should close the open transaction without any
+	// further Put.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		open := b.open
+		s.mu.Unlock()
+		if !open {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("batch was not committed by the interval timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close batch: %v", err)
+	}
+
+	got, err := s.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(got) != 1 || got[0].Hash != "new" {
+		t.Fatalf("Dump = %+v, want one updated row", got)
+	}
+}
+
+// badTime is a modification time the database cannot store, so writing a row
+// with it fails.
+var badTime = time.Unix(2, 0).In(time.FixedZone("bad", 1<<30))
+
+func TestBatchPutFailureKeepsOtherRows(t *testing.T) {
+	s := openTest(t)
+	if err := s.Upsert(FileInfo{Path: "/u", ModTime: time.Unix(1, 0), Hash: "old"}, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	// The failing row comes in the middle of a transaction holding an insert
+	// and an update.
+	b := s.NewBatch(10, time.Hour)
+	for _, fi := range []FileInfo{
+		{Path: "/a", ModTime: time.Unix(1, 0)},
+		{Path: "/u", ModTime: time.Unix(1, 0), Hash: "new"},
+		{Path: "/bad", ModTime: badTime},
+		{Path: "/c", ModTime: time.Unix(1, 0)},
+	} {
+		err := b.Put(fi, false)
+		if (err != nil) != (fi.Path == "/bad") {
+			t.Fatalf("Put %s: %v", fi.Path, err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if failed := b.Failed(); len(failed) != 0 {
+		t.Fatalf("Failed = %+v, want no rows lost", failed)
+	}
+	if ins, upd := b.Written(); ins != 2 || upd != 1 {
+		t.Fatalf("Written = %d, %d; want 2 inserted, 1 updated", ins, upd)
+	}
+	got, err := s.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	rows := make(map[string]string)
+	for _, fi := range got {
+		rows[fi.Path] = fi.Hash
+	}
+	if want := map[string]string{"/a": "", "/c": "", "/u": "new"}; !maps.Equal(rows, want) {
+		t.Fatalf("rows = %v, want %v", rows, want)
+	}
+}
+
+func TestBatchCommitFailureReportsRows(t *testing.T) {
+	s := openTest(t)
+	if err := s.Upsert(FileInfo{Path: "/u", ModTime: time.Unix(1, 0)}, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	// Changed rows are only written on commit, so a bad one fails the commit
+	// and every row in the transaction is lost.
+	b := s.NewBatch(10, time.Hour)
+	for _, fi := range []FileInfo{
+		{Path: "/a", ModTime: time.Unix(1, 0)},
+		{Path: "/u", ModTime: badTime},
+		{Path: "/c", ModTime: time.Unix(1, 0)},
+	} {
+		if err := b.Put(fi, false); err != nil {
+			t.Fatalf("Put %s: %v", fi.Path, err)
+		}
+	}
+	if err := b.Close(); err == nil {
+		t.Fatal("Close committed a row the database cannot store")
+	}
+	var lost []string
+	for _, e := range b.Failed() {
+		lost = append(lost, e.Path)
+	}
+	if want := "[/a /u /c]"; fmt.Sprint(lost) != want {
+		t.Fatalf("Failed = %v, want %s", lost, want)
+	}
+	if ins, upd := b.Written(); ins != 0 || upd != 0 {
+		t.Fatalf("Written = %d, %d; want nothing", ins, upd)
+	}
+	if got, err := s.Dump(""); err != nil || len(got) != 1 {
+		t.Fatalf("Dump = %+v, %v; want only the old /u", got, err)
+	}
+}
+
+// BenchmarkUpsert and BenchmarkBatchPut write b.N new rows, one transaction per
+// row versus one per DefaultBatchSize rows.
+func BenchmarkUpsert(b *testing.B) {
+	s, err := Open(b.TempDir(), "benchhost")
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	b.ResetTimer()
+	for i := range b.N {
+		fi := FileInfo{Path: fmt.Sprintf("/bench/%08d", i), Size: int64(i), ModTime: time.Unix(1, 0)}
+		if err := s.Upsert(fi, false); err != nil {
+			b.Fatalf("Upsert: %v", err)
+		}
+	}
+}
+
+func BenchmarkBatchPut(b *testing.B) {
+	s, err := Open(b.TempDir(), "benchhost")
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	b.ResetTimer()
+	batch := s.NewBatch(0, 0)
+	for i := range b.N {
+		fi := FileInfo{Path: fmt.Sprintf("/bench/%08d", i), Size: int64(i), ModTime: time.Unix(1, 0)}
+		if err := batch.Put(fi, false); err != nil {
+			b.Fatalf("Put: %v", err)
+		}
+	}
+	if err := batch.Close(); err != nil {
+		b.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ChangeKind says how a file changed.
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "added"
+	Modified ChangeKind = "modified"
+	Deleted  ChangeKind = "deleted"
+)
+
+// Change is one entry of a file's history. Size, ModTime and the hash are the
+// file's values before the change, or for an added file its first values.
+type Change struct {
+	Host     string
+	Path     string
+	Run      int64     // the run that saw the change
+	Time     time.Time // when it was recorded
+	Kind     ChangeKind
+	Size     int64
+	ModTime  time.Time
+	Hash     string
+	HashAlgo string
+}
+
+// RecordHistory attributes the file changes this store writes from now on to
+// run, recording them in the history table, until it is called again. Run 0
+// turns history off, which is the default. Only regular files are recorded,
+// and a row whose metadata changes while its content does not (by size, mtime
+// and digest) is not recorded as modified.
+func (s *Store) RecordHistory(run int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.historyRun = run
+}
+
+// recordChange adds a history entry for fi if history is on. It must run
+// inside a transaction. Callers must hold s.mu.
+func (s *Store) recordChange(kind ChangeKind, fi FileInfo) error {
+	if s.historyRun == 0 || (fi.Type != TypeFile && fi.Type != "") {
+		return nil
+	}
+	if _, _, err := s.db.Run(s.ctx, `
+		INSERT INTO history (hostname, filename, run, changed, kind, size, modtimestamp, hash, hashalgo)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+		s.hostname, fi.Path, s.historyRun, time.Now(), string(kind),
+		fi.Size, fi.ModTime, fi.Hash, fi.HashAlgo); err != nil {
+		return fmt.Errorf("record %s %q: %w", kind, fi.Path, err)
+	}
+	return nil
+}
+
+// contentChanged reports whether fi records different content from old:
+// another size or mtime, or another digest of the same algorithm. A digest
+// filled in or replaced by another algorithm's says nothing about the
+// content.
+func contentChanged(old, fi FileInfo) bool {
+	if old.Size != fi.Size || !old.ModTime.Equal(fi.ModTime) {
+		return true
+	}
+	return old.Hash != "" && fi.Hash != "" && old.HashAlgo == fi.HashAlgo && old.Hash != fi.Hash
+}
+
+// Changes returns host's history ("" for this store's host, or AllHosts)
+// recorded by runs after afterRun, up to and including throughRun unless that
+// is 0, and no earlier than since, oldest first. Pass 0, 0 and the zero time
+// to get everything.
+func (s *Store) Changes(host string, afterRun, throughRun int64, since time.Time) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rss, _, err := s.db.Run(s.ctx, `
+		SELECT hostname, filename, run, changed, kind, size, modtimestamp, hash, hashalgo
+		FROM history
+		WHERE run > $2 && ($3 == 0 || run <= $3) && changed >= $4 && ($1 == "" || hostname == $1)
+		ORDER BY changed;`,
+		s.hostArg(host), afterRun, throughRun, since)
+	if err != nil {
+		return nil, fmt.Errorf("select history: %w", err)
+	}
+	cols, err := fieldsOf(rss[0])
+	if err != nil {
+		return nil, fmt.Errorf("select history: %w", err)
+	}
+	var out []Change
+	if err := rss[0].Do(false, func(data []any) (bool, error) {
+		out = append(out, Change{
+			Host:     value[string](cols, data, "hostname"),
+			Path:     value[string](cols, data, "filename"),
+			Run:      value[int64](cols, data, "run"),
+			Time:     value[time.Time](cols, data, "changed"),
+			Kind:     ChangeKind(value[string](cols, data, "kind")),
+			Size:     value[int64](cols, data, "size"),
+			ModTime:  value[time.Time](cols, data, "modtimestamp"),
+			Hash:     value[string](cols, data, "hash"),
+			HashAlgo: value[string](cols, data, "hashalgo"),
+		})
+		return true, nil
+	}); err != nil {
+		return nil, fmt.Errorf("iterate history: %w", err)
+	}
+	return out, nil
+}
+
+// PruneHistory deletes the history recorded before t on every host.
+func (s *Store) PruneHistory(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.inTx(func() error {
+		_, _, err := s.db.Run(s.ctx, "DELETE FROM history WHERE changed < $1;", t)
+		return err
+	}); err != nil {
+		return fmt.Errorf("prune history: %w", err)
+	}
+	return nil
+}
+
+// NetChanges reduces changes, oldest first, to one per file, saying how each
+// file differs between the start and the end of the period they cover: a
+// file added then modified was added, one added then deleted is left out, and
+// one deleted then added again was modified. Each result is the file's first
+// change, with the net Kind, so its values are those from before the period.
+// Results are sorted by host, then path.
+func NetChanges(changes []Change) []Change {
+	type key struct{ host, path string }
+	first := make(map[key]Change)
+	last := make(map[key]ChangeKind)
+	for _, c := range changes {
+		k := key{c.Host, c.Path}
+		if _, ok := first[k]; !ok {
+			first[k] = c
+		}
+		last[k] = c.Kind
+	}
+
+	var out []Change
+	for k, c := range first {
+		switch {
+		case c.Kind == Added && last[k] == Deleted:
+			continue
+		case c.Kind == Added:
+		case last[k] == Deleted:
+			c.Kind = Deleted
+		default:
+			c.Kind = Modified
+		}
+		out = append(out, c)
+	}
+	slices.SortFunc(out, func(a, b Change) int {
+		return cmp.Or(cmp.Compare(a.Host, b.Host), cmp.Compare(a.Path, b.Path))
+	})
+	return out
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	s := openTest(t)
+	upsert := func(fi FileInfo) {
+		t.Helper()
+		if err := s.Upsert(fi, false); err != nil {
+			t.Fatalf("Upsert %s: %v", fi.Path, err)
+		}
+	}
+	a := FileInfo{Path: "/a", Size: 1, ModTime: time.Unix(1, 0), Type: TypeFile, Hash: "h1", HashAlgo: "xxh3"}
+
+	upsert(a) // history is off
+	s.RecordHistory(7)
+	changed := a
+	changed.Size, changed.Hash = 2, "h2"
+	upsert(changed)
+	chmod := changed
+	chmod.Mode = 0o600
+	upsert(chmod)                                                           // metadata only
+	upsert(FileInfo{Path: "/dir", ModTime: time.Unix(1, 0), Type: TypeDir}) // not a file
+	upsert(FileInfo{Path: "/b", Size: 3, ModTime: time.Unix(3, 0), Type: TypeFile})
+	if err := s.Delete([]string{"/a"}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	s.RecordHistory(0)
+	upsert(a)
+
+	got, err := s.Changes("", 0, 0, time.Time{})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	type entry struct {
+		kind ChangeKind
+		path string
+		size int64
+		hash string
+	}
+	var entries []entry
+	for _, c := range got {
+		if c.Run != 7 || c.Host != "testhost" || c.Time.IsZero() {
+			t.Fatalf("change %+v not attributed to run 7", c)
+		}
+		entries = append(entries, entry{c.Kind, c.Path, c.Size, c.Hash})
+	}
+	want := []entry{
+		{Modified, "/a", 1, "h1"}, // the values before the change
+		{Added, "/b", 3, ""},
+		{Deleted, "/a", 2, "h2"},
+	}
+	if !slices.Equal(entries, want) {
+		t.Fatalf("history = %+v, want %+v", entries, want)
+	}
+
+	if got, err := s.Changes("", 7, 0, time.Time{}); err != nil || len(got) != 0 {
+		t.Fatalf("Changes after run 7 = %+v, %v", got, err)
+	}
+	s.RecordHistory(8)
+	upsert(FileInfo{Path: "/c", Size: 4, ModTime: time.Unix(4, 0), Type: TypeFile})
+	s.RecordHistory(0)
+	if got, err := s.Changes("", 6, 7, time.Time{}); err != nil || len(got) != len(want) {
+		t.Fatalf("Changes of run 7 alone = %+v, %v; want %d", got, err, len(want))
+	}
+	if got, err := s.Changes("", 0, 0, time.Now().Add(time.Hour)); err != nil || len(got) != 0 {
+		t.Fatalf("Changes in the future = %+v, %v", got, err)
+	}
+
+	if err := s.PruneHistory(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("PruneHistory: %v", err)
+	}
+	if got, err := s.Changes("", 0, 0, time.Time{}); err != nil || len(got) != 0 {
+		t.Fatalf("Changes after pruning = %+v, %v", got, err)
+	}
+}
+
+func TestNetChanges(t *testing.T) {
+	in := []Change{
+		{Path: "/added", Kind: Added, Size: 1},
+		{Path: "/added", Kind: Modified, Size: 1},
+		{Path: "/transient", Kind: Added},
+		{Path: "/transient", Kind: Deleted},
+		{Path: "/replaced", Kind: Deleted, Size: 5},
+		{Path: "/replaced", Kind: Added, Size: 6},
+		{Path: "/gone", Kind: Modified, Size: 7},
+		{Path: "/gone", Kind: Deleted, Size: 8},
+		{Path: "/edited", Kind: Modified, Size: 9},
+	}
+	type net struct {
+		path string
+		kind ChangeKind
+		size int64
+	}
+	var got []net
+	for _, c := range NetChanges(in) {
+		got = append(got, net{c.Path, c.Kind, c.Size})
+	}
+	want := []net{
+		{"/added", Added, 1},
+		{"/edited", Modified, 9},
+		{"/gone", Deleted, 7},
+		{"/replaced", Modified, 5},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("NetChanges = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// flock is a no-op where flock(2) is unavailable. A reader opened there while
+// a writer is committing can copy an inconsistent snapshot.
+func flock(*os.File, bool) error { return nil }
+
+func funlock(*os.File) error { return nil }
+
+// tryFlock reports the lock as held by another, so that without flock(2) every
+// reader takes a private snapshot rather than share the cached one.
+func tryFlock(*os.File) (bool, error) { return false, nil }
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Run statuses. A run that never finished, e.g. because the process was
+// killed, stays RunRunning.
+const (
+	RunRunning   = "running"
+	RunDone      = "done"
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+)
+
+// Run records one indexing run of a tree.
+type Run struct {
+	ID       int64
+	Host     string
+	Root     string
+	Options  string // the indexing options, as index.Options.String describes them
+	Started  time.Time
+	Finished time.Time // zero while running
+	Status   string    // RunRunning, RunDone, RunFailed or RunCancelled
+
+	// Checkpoint is the last directory, in walk order, whose entries were all
+	// written, so a run that did not finish can be resumed after it. Every
+	// path before it in walk order, and every path below it, is indexed.
+	Checkpoint string
+	Resumed    int64 // the run this one resumed from its Checkpoint, or 0
+
+	Seen     int64 // entries the walk visited
+	Hashed   int64 // files whose content was hashed
+	Inserted int64 // rows added
+	Updated  int64 // rows changed
+	Errors   int64 // entries that could not be read, hashed or written
+}
+
+// BeginRun records the start of a run of r.Root on this host and returns its
+// ID. Only r.Root, r.Options, r.Started, r.Resumed and r.Checkpoint are used;
+// a resumed run starts at the checkpoint of the run it resumes.
+func (s *Store) BeginRun(r Run) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var id int64
+	err := s.inTx(func() error {
+		if _, _, err := s.db.Run(s.ctx, `
+			INSERT INTO runs (hostname, root, options, started, status, checkpoint, resumed)
+			VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+			s.hostname, r.Root, r.Options, r.Started, RunRunning, r.Checkpoint, r.Resumed); err != nil {
+			return err
+		}
+		id = s.ctx.LastInsertID
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("record run of %q: %w", r.Root, err)
+	}
+	return id, nil
+}
+
+// EndRun records how the run r.ID ended: its status, finish time and counts.
+func (s *Store) EndRun(r Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.inTx(func() error {
+		_, _, err := s.db.Run(s.ctx, `
+			UPDATE runs
+			SET finished = $2, status = $3, seen = $4, hashed = $5, inserted = $6, updated = $7, errors = $8
+			WHERE id() == $1;`,
+			r.ID, r.Finished, r.Status, r.Seen, r.Hashed, r.Inserted, r.Updated, r.Errors)
+		return err
+	}); err != nil {
+		return fmt.Errorf("record end of run %d: %w", r.ID, err)
+	}
+	return nil
+}
+
+// setCheckpoint records path as run's checkpoint. It must run inside a
+// transaction. Callers must hold s.mu.
+func (s *Store) setCheckpoint(run int64, path string) error {
+	if _, _, err := s.db.Run(s.ctx, "UPDATE runs SET checkpoint = $2 WHERE id() == $1;", run, path); err != nil {
+		return fmt.Errorf("record checkpoint of run %d: %w", run, err)
+	}
+	return nil
+}
+
+// Runs returns host's runs ("" for this store's host, or AllHosts), newest
+// first.
+func (s *Store) Runs(host string) ([]Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rss, _, err := s.db.Run(s.ctx, `
+		SELECT id() AS id, hostname, root, options, started, finished, status,
+			checkpoint, resumed, seen, hashed, inserted, updated, errors
+		FROM runs
+		WHERE $1 == "" || hostname == $1
+		ORDER BY started, id DESC;`,
+		s.hostArg(host))
+	if err != nil {
+		return nil, fmt.Errorf("select runs: %w", err)
+	}
+	cols, err := fieldsOf(rss[0])
+	if err != nil {
+		return nil, fmt.Errorf("select runs: %w", err)
+	}
+	var runs []Run
+	if err := rss[0].Do(false, func(data []any) (bool, error) {
+		runs = append(runs, Run{
+			ID:         value[int64](cols, data, "id"),
+			Host:       value[string](cols, data, "hostname"),
+			Root:       value[string](cols, data, "root"),
+			Options:    value[string](cols, data, "options"),
+			Started:    value[time.Time](cols, data, "started"),
+			Finished:   value[time.Time](cols, data, "finished"),
+			Status:     value[string](cols, data, "status"),
+			Checkpoint: value[string](cols, data, "checkpoint"),
+			Resumed:    value[int64](cols, data, "resumed"),
+			Seen:       value[int64](cols, data, "seen"),
+			Hashed:     value[int64](cols, data, "hashed"),
+			Inserted:   value[int64](cols, data, "inserted"),
+			Updated:    value[int64](cols, data, "updated"),
+			Errors:     value[int64](cols, data, "errors"),
+		})
+		return true, nil
+	}); err != nil {
+		return nil, fmt.Errorf("iterate runs: %w", err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuns(t *testing.T) {
+	s := openTest(t)
+
+	first, err := s.BeginRun(Run{Root: "/a", Options: "hash=xxh3", Started: time.Unix(100, 0)})
+	if err != nil {
+		t.Fatalf("BeginRun: %v", err)
+	}
+	second, err := s.BeginRun(Run{Root: "/b", Started: time.Unix(200, 0)})
+	if err != nil {
+		t.Fatalf("BeginRun: %v", err)
+	}
+	if first == second {
+		t.Fatalf("both runs got ID %d", first)
+	}
+	end := Run{ID: first, Finished: time.Unix(150, 0), Status: RunDone,
+		Seen: 5, Hashed: 4, Inserted: 3, Updated: 2, Errors: 1}
+	if err := s.EndRun(end); err != nil {
+		t.Fatalf("EndRun: %v", err)
+	}
+
+	runs, err := s.Runs("")
+	if err != nil {
+		t.Fatalf("Runs: %v", err)
+	}
+	if len(runs) != 2 || runs[0].ID != second || runs[1].ID != first {
+		t.Fatalf("Runs = %+v, want the two runs newest first", runs)
+	}
+	if r := runs[0]; r.Status != RunRunning || !r.Finished.IsZero() || r.Host != "testhost" {
+		t.Fatalf("unfinished run = %+v", r)
+	}
+	got := runs[1]
+	want := end
+	want.Host, want.Root, want.Options, want.Started = "testhost", "/a", "hash=xxh3", time.Unix(100, 0)
+	if !got.Started.Equal(want.Started) || !got.Finished.Equal(want.Finished) {
+		t.Fatalf("finished run times = %v..%v, want %v..%v", got.Started, got.Finished, want.Started, want.Finished)
+	}
+	got.Started, got.Finished, want.Started, want.Finished = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	if got != want {
+		t.Fatalf("finished run = %+v, want %+v", got, want)
+	}
+
+	if runs, err := s.Runs("otherhost"); err != nil || len(runs) != 0 {
+		t.Fatalf("Runs(otherhost) = %+v, %v", runs, err)
+	}
+}
+
+func TestBatchCheckpoint(t *testing.T) {
+	s := openTest(t)
+
+	id, err := s.BeginRun(Run{Root: "/a", Started: time.Unix(100, 0), Resumed: 7, Checkpoint: "/a/b"})
+	if err != nil {
+		t.Fatalf("BeginRun: %v", err)
+	}
+	checkpoint := func() string {
+		t.Helper()
+		runs, err := s.Runs("")
+		if err != nil || len(runs) != 1 || runs[0].Resumed != 7 {
+			t.Fatalf("Runs = %+v, %v", runs, err)
+		}
+		return runs[0].Checkpoint
+	}
+	if got := checkpoint(); got != "/a/b" {
+		t.Fatalf("checkpoint = %q, want the resumed run's", got)
+	}
+
+	b := s.NewBatch(0, time.Hour)
+	if err := b.Put(FileInfo{Path: "/a/c/f", Size: 1}, false); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	b.Checkpoint(id, "/a/c")
+	if got := checkpoint(); got != "/a/b" {
+		t.Fatalf("checkpoint before a commit = %q, want the old one", got)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := checkpoint(); got != "/a/c" {
+		t.Fatalf("checkpoint after a commit = %q, want /a/c", got)
+	}
+	// A checkpoint is recorded even when no rows were written since.
+	b.Checkpoint(id, "/a/d")
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := checkpoint(); got != "/a/d" {
+		t.Fatalf("checkpoint = %q, want /a/d", got)
+	}
+}
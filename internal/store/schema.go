@@ -0,0 +1,331 @@
+package store
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/ql"
+)
+
+// migration upgrades the schema by one version. Its optional fix function and
+// then its statements run in the same transaction as the version bump, so a
+// migration is applied entirely or not at all.
+type migration struct {
+	version int64
+	stmts   string
+	fix     func(*Store) error // repairs data the statements depend on; may be nil
+}
+
+// migrations is the ordered schema history. Append new versions to the end and
+// never edit one that has shipped: existing databases have already applied it.
+//
+// Version 1 is the original files table. It uses IF NOT EXISTS so databases
+// created before versioning, which already have the table, adopt it as-is.
+var migrations = []migration{
+	{1, `
+		CREATE TABLE IF NOT EXISTS files (
+			hostname string,
+			filename string,
+			size int64,
+			modtimestamp time,
+			imohash string,
+			xxh3hash string,
+		);`, nil},
+	// Version 2 makes (hostname, filename) a real key. Earlier versions
+	// updated rows by filename alone, which could rewrite another host's row
+	// into a duplicate of this host's, so those are removed first.
+	{2, `
+		CREATE UNIQUE INDEX IF NOT EXISTS files_host_filename ON files (hostname, filename);`,
+		dedupeFiles},
+	// Version 3 adds the indexes behind per-file lookups during indexing
+	// (filename) and duplicate detection (xxh3hash). Without them both are
+	// full-table scans, which makes indexing quadratic in the table size. The
+	// doomed table stages row ids for bulk deletes; see Store.deleteIDs.
+	{3, `
+		CREATE INDEX IF NOT EXISTS files_filename ON files (filename);
+		CREATE INDEX IF NOT EXISTS files_xxh3hash ON files (xxh3hash);
+		CREATE TABLE IF NOT EXISTS doomed (id int64);`, nil},
+	// Version 4 records the inode, which with size and mtime tells the indexer
+	// whether a file changed since it was last hashed. Existing rows read as
+	// inode 0, meaning unknown.
+	{4, `
+		ALTER TABLE files ADD inode int64;`, nil},
+	// Version 5 records the rest of the entry's stat metadata. Existing rows
+	// read as zero (unknown) and are filled in the next time their tree is
+	// indexed.
+	{5, `
+		ALTER TABLE files ADD filetype string;
+		ALTER TABLE files ADD mode int64;
+		ALTER TABLE files ADD uid int64;
+		ALTER TABLE files ADD gid int64;
+		ALTER TABLE files ADD device int64;
+		ALTER TABLE files ADD nlink int64;
+		ALTER TABLE files ADD ctime time;`, nil},
+	// Version 6 makes the full-content hash algorithm pluggable: the digest
+	// moves from xxh3hash to hash, alongside the name of the algorithm that
+	// produced it, so digests of different algorithms are never compared.
+	// Existing digests are all xxh3. The emptied xxh3hash column stays: ql
+	// mis-reads older rows once a dropped column is followed by an added one.
+	{6, `
+		ALTER TABLE files ADD hash string;
+		ALTER TABLE files ADD hashalgo string;
+		UPDATE files SET hash = xxh3hash, hashalgo = "xxh3", xxh3hash = "" WHERE xxh3hash > "";
+		DROP INDEX files_xxh3hash;
+		CREATE INDEX files_hash ON files (hash);`, nil},
+	// Version 7 records every indexing run, so users can tell when and how a
+	// tree was last indexed. See Store.BeginRun.
+	{7, `
+		CREATE TABLE runs (
+			hostname string,
+			root string,
+			options string,
+			started time,
+			finished time,
+			status string,
+			seen int64,
+			hashed int64,
+			inserted int64,
+			updated int64,
+			errors int64,
+		);`, nil},
+	// Version 8 adds the per-file change history. See Store.RecordHistory.
+	{8, `
+		CREATE TABLE history (
+			hostname string,
+			filename string,
+			run int64,
+			changed time,
+			kind string,
+			size int64,
+			modtimestamp time,
+			hash string,
+			hashalgo string,
+		);
+		CREATE INDEX history_run ON history (run);
+		CREATE INDEX history_changed ON history (changed);`, nil},
+	// Version 9 lets an interrupted run be resumed: each run records how far
+	// it got, and which run it resumed. See Run.Checkpoint.
+	{9, `
+		ALTER TABLE runs ADD checkpoint string;
+		ALTER TABLE runs ADD resumed int64;`, nil},
+}
+
+// schemaVersionKey is the meta row holding the applied schema version.
+const schemaVersionKey = "schema_version"
+
+// migrate brings the database up to the last version in migs, one transaction
+// per migration. It refuses to open a database written by a newer gocate,
+// whose schema it cannot know how to read. Callers must hold s.mu.
+func (s *Store) migrate(migs []migration) error {
+	if err := s.inTx(func() error {
+		_, _, err := s.db.Run(s.ctx, `
+			CREATE TABLE IF NOT EXISTS meta (
+				key string,
+				value string,
+			);`)
+		return err
+	}); err != nil {
+		return fmt.Errorf("create meta table: %w", err)
+	}
+
+	current, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := migs[len(migs)-1].version
+	if current > latest {
+		return fmt.Errorf("db schema version %d is newer than this gocate supports (%d)", current, latest)
+	}
+
+	for _, m := range migs {
+		if m.version <= current {
+			continue
+		}
+		if err := s.inTx(func() error {
+			if m.fix != nil {
+				if err := m.fix(s); err != nil {
+					return err
+				}
+			}
+			if _, _, err := s.db.Run(s.ctx, m.stmts); err != nil {
+				return err
+			}
+			return s.setMeta(schemaVersionKey, strconv.FormatInt(m.version, 10))
+		}); err != nil {
+			return fmt.Errorf("migrate db to schema version %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// dedupeFiles deletes all but the oldest row for each (hostname, filename). It
+// must run inside a transaction. Callers must hold s.mu.
+func dedupeFiles(s *Store) error {
+	rss, _, err := s.db.Run(s.ctx, "SELECT id(), hostname, filename FROM files ORDER BY id();")
+	if err != nil {
+		return fmt.Errorf("select for dedupe: %w", err)
+	}
+
+	type key struct{ host, path string }
+	seen := make(map[key]bool)
+	var extra []int64
+	if err := rss[0].Do(false, func(data []any) (bool, error) {
+		id, _ := data[0].(int64)
+		k := key{}
+		k.host, _ = data[1].(string)
+		k.path, _ = data[2].(string)
+		if seen[k] {
+			extra = append(extra, id)
+		}
+		seen[k] = true
+		return true, nil
+	}); err != nil {
+		return fmt.Errorf("iterate for dedupe: %w", err)
+	}
+
+	for _, id := range extra {
+		if _, _, err := s.db.Run(s.ctx, "DELETE FROM files WHERE id() == $1;", id); err != nil {
+			return fmt.Errorf("delete duplicate row %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the applied schema version, 0 for a new or
+// pre-versioning database. Callers must hold s.mu.
+func (s *Store) schemaVersion() (int64, error) {
+	v, ok, err := s.meta(schemaVersionKey)
+	if err != nil || !ok {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse schema version %q: %w", v, err)
+	}
+	return n, nil
+}
+
+// Meta returns the value stored under key in the meta table, where callers
+// keep state that must outlive a run, such as where to resume a long pass.
+func (s *Store) Meta(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meta(key)
+}
+
+// SetMeta stores value under key in the meta table, in its own transaction.
+func (s *Store) SetMeta(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inTx(func() error { return s.setMeta(key, value) })
+}
+
+// meta returns the value stored under key in the meta table. Callers must hold s.mu.
+func (s *Store) meta(key string) (string, bool, error) {
+	rss, _, err := s.db.Run(s.ctx, "SELECT value FROM meta WHERE key == $1;", key)
+	if err != nil {
+		return "", false, fmt.Errorf("read meta %q: %w", key, err)
+	}
+	fr, err := rss[0].FirstRow()
+	if err != nil {
+		return "", false, fmt.Errorf("read meta %q: %w", key, err)
+	}
+	if fr == nil {
+		return "", false, nil
+	}
+	v, _ := fr[0].(string)
+	return v, true, nil
+}
+
+// setMeta stores value under key in the meta table. It must run inside a
+// transaction. Callers must hold s.mu.
+func (s *Store) setMeta(key, value string) error {
+	if _, _, err := s.db.Run(s.ctx, "DELETE FROM meta WHERE key == $1;", key); err != nil {
+		return fmt.Errorf("write meta %q: %w", key, err)
+	}
+	if _, _, err := s.db.Run(s.ctx, "INSERT INTO meta (key, value) VALUES ($1, $2);", key, value); err != nil {
+		return fmt.Errorf("write meta %q: %w", key, err)
+	}
+	return nil
+}
+
+// fileColumns lists the files columns gocate writes, in the order fileArgs
+// binds them.
+const fileColumns = `hostname, filename, size, modtimestamp, imohash, hash, hashalgo, ` +
+	`filetype, mode, uid, gid, inode, device, nlink, ctime`
+
+// fileArgs returns the values of fileColumns for fi on host. ql has no
+// unsigned 64-bit column type worth the conversions, so the unsigned stat
+// fields are stored bit-for-bit as int64.
+func fileArgs(host string, fi FileInfo) []any {
+	return []any{host, fi.Path, fi.Size, fi.ModTime, fi.Imohash, fi.Hash, fi.HashAlgo,
+		string(fi.Type), int64(fi.Mode), int64(fi.UID), int64(fi.GID),
+		int64(fi.Inode), int64(fi.Device), int64(fi.Nlink), fi.ChangeTime}
+}
+
+// placeholders returns "$1, $2, ..., $n".
+func placeholders(n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = "$" + strconv.Itoa(i+1)
+	}
+	return strings.Join(ps, ", ")
+}
+
+// columns maps the field names of a result set to their positions, so rows can
+// be read by column name regardless of column order or columns added later.
+type columns map[string]int
+
+// fieldsOf returns the columns of rs.
+func fieldsOf(rs ql.Recordset) (columns, error) {
+	names, err := rs.Fields()
+	if err != nil {
+		return nil, fmt.Errorf("read fields: %w", err)
+	}
+	c := make(columns, len(names))
+	for i, n := range names {
+		c[n] = i
+	}
+	return c, nil
+}
+
+// file builds a FileInfo from a row. Columns absent from the result set leave
+// their field zero.
+func (c columns) file(data []any) FileInfo {
+	return FileInfo{
+		Host:     value[string](c, data, "hostname"),
+		Path:     value[string](c, data, "filename"),
+		Size:     value[int64](c, data, "size"),
+		ModTime:  value[time.Time](c, data, "modtimestamp"),
+		Imohash:  value[string](c, data, "imohash"),
+		Hash:     value[string](c, data, "hash"),
+		HashAlgo: value[string](c, data, "hashalgo"),
+
+		Type:       FileType(value[string](c, data, "filetype")),
+		Mode:       fs.FileMode(value[int64](c, data, "mode")),
+		UID:        uint32(value[int64](c, data, "uid")),
+		GID:        uint32(value[int64](c, data, "gid")),
+		Inode:      uint64(value[int64](c, data, "inode")),
+		Device:     uint64(value[int64](c, data, "device")),
+		Nlink:      uint64(value[int64](c, data, "nlink")),
+		ChangeTime: value[time.Time](c, data, "ctime"),
+	}
+}
+
+// value returns the named column of data as a T, or T's zero value if the
+// column is missing or NULL.
+func value[T any](c columns, data []any, name string) T {
+	var zero T
+	i, ok := c[name]
+	if !ok || i >= len(data) {
+		return zero
+	}
+	v, ok := data[i].(T)
+	if !ok {
+		return zero
+	}
+	return v
+}
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"modernc.org/ql"
+)
+
+// writeV1Fixture creates a database in dir exactly as gocate did before schema
+// versioning: a bare files table with no meta table, holding two rows.
+func writeV1Fixture(t *testing.T, dir string) {
+	t.Helper()
+	db, err := ql.OpenFile(filepath.Join(dir, dbName), &ql.Options{CanCreate: true, FileFormat: 2})
+	if err != nil {
+		t.Fatalf("create fixture: %v", err)
+	}
+	if _, _, err := db.Run(ql.NewRWCtx(), `
+		BEGIN TRANSACTION;
+			CREATE TABLE IF NOT EXISTS files (
+				hostname string,
+				filename string,
+				size int64,
+				modtimestamp time,
+				imohash string,
+				xxh3hash string,
+			);
+			INSERT INTO files VALUES("testhost", "/v1/a.txt", 3, $1, "imo-a", "xxh-a");
+			INSERT INTO files VALUES("testhost", "/v1/b.txt", 5, $1, "imo-b", "xxh-b");
+		COMMIT;`, time.Unix(100, 0)); err != nil {
+		t.Fatalf("populate fixture: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close fixture: %v", err)
+	}
+}
+
+func TestOpenUpgradesV1Database(t *testing.T) {
+	dir := t.TempDir()
+	writeV1Fixture(t, dir)
+
+	s, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	v, err := s.schemaVersion()
+	if err != nil {
+		t.Fatalf("schemaVersion: %v", err)
+	}
+	if want := migrations[len(migrations)-1].version; v != want {
+		t.Fatalf("schema version = %d, want %d", v, want)
+	}
+
+	got, err := s.Search("", `a\.txt$`)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	want := FileInfo{Path: "/v1/a.txt", Size: 3, ModTime: time.Unix(100, 0), Imohash: "imo-a", HashAlgo: "xxh3", Hash: "xxh-a"}
+	if len(got) != 1 || !sameFile(got[0], want) {
+		t.Fatalf("v1 row after upgrade = %+v, want %+v", got, want)
+	}
+}
+
+func TestOpenReadOnlyUpgradesSnapshotOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeV1Fixture(t, dir)
+
+	r, err := OpenReadOnly(dir, "testhost")
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %v", err)
+	}
+	rows, err := r.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Dump returned %d rows, want 2", len(rows))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The original must still be unversioned.
+	db, err := ql.OpenFile(filepath.Join(dir, dbName), &ql.Options{})
+	if err != nil {
+		t.Fatalf("open fixture: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	info, err := db.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	for _, tbl := range info.Tables {
+		if tbl.Name == "meta" {
+			t.Fatal("read-only open migrated the original database")
+		}
+	}
+}
+
+// TestMigrateAddedColumn checks that a later migration adding a column keeps
+// existing rows readable and writable, since rows are accessed by column name.
+func TestMigrateAddedColumn(t *testing.T) {
+	dir := t.TempDir()
+	writeV1Fixture(t, dir)
+
+	s, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	next := migrations[len(migrations)-1].version + 1
+	migs := append(migrations[:len(migrations):len(migrations)],
+		migration{next, `ALTER TABLE files ADD note string;`, nil})
+	if err := s.migrate(migs); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if v, _ := s.schemaVersion(); v != next {
+		t.Fatalf("schema version = %d, want %d", v, next)
+	}
+
+	fi := FileInfo{Path: "/v2/c.txt", Size: 7, ModTime: time.Unix(200, 0), Imohash: "imo-c", HashAlgo: "xxh3", Hash: "xxh-c"}
+	if err := s.Upsert(fi, false); err != nil {
+		t.Fatalf("Upsert after migration: %v", err)
+	}
+	rows, err := s.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Dump returned %d rows, want 3", len(rows))
+	}
+	for _, r := range rows {
+		if r.Path == fi.Path && !sameFile(r, fi) {
+			t.Fatalf("row read back as %+v, want %+v", r, fi)
+		}
+		if r.Size == 0 || r.Hash == "" {
+			t.Fatalf("row %+v read from shifted columns", r)
+		}
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	s := openTest(t)
+
+	if err := s.inTx(func() error { return s.setMeta(schemaVersionKey, "999") }); err != nil {
+		t.Fatalf("setMeta: %v", err)
+	}
+	err := s.migrate(migrations)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("migrate on a newer schema = %v, want an error", err)
+	}
+}
+
+func sameFile(a, b FileInfo) bool {
+	return a.Path == b.Path && a.Size == b.Size && a.ModTime.Equal(b.ModTime) &&
+		a.Imohash == b.Imohash && a.Hash == b.Hash && a.HashAlgo == b.HashAlgo
+}
+
+func TestMigrateDedupesHostKey(t *testing.T) {
+	dir := t.TempDir()
+	writeV1Fixture(t, dir)
+
+	// Reproduce what the pre-v2 filename-only UPDATE could leave behind: two
+	// rows for the same (hostname, filename).
+	db, err := ql.OpenFile(filepath.Join(dir, dbName), &ql.Options{})
+	if err != nil {
+		t.Fatalf("open fixture: %v", err)
+	}
+	if _, _, err := db.Run(ql.NewRWCtx(), `
+		BEGIN TRANSACTION;
+			INSERT INTO files VALUES("testhost", "/v1/a.txt", 3, $1, "imo-a", "xxh-a");
+		COMMIT;`, time.Unix(100, 0)); err != nil {
+		t.Fatalf("insert duplicate: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close fixture: %v", err)
+	}
+
+	s, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	rows, err := s.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Dump returned %d rows after migration, want 2: %+v", len(rows), rows)
+	}
+}
+
+func TestOpenIndexesExistingDatabase(t *testing.T) {
+	dir := t.TempDir()
+	writeV1Fixture(t, dir)
+
+	s, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	info, err := s.db.Info()
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	have := make(map[string]bool)
+	for _, x := range info.Indices {
+		have[x.Name] = true
+	}
+	for _, want := range []string{"files_host_filename", "files_filename", "files_hash"} {
+		if !have[want] {
+			t.Errorf("index %s missing after upgrade", want)
+		}
+	}
+
+	// The per-file lookup must go through files_filename, not a table scan.
+	rss, _, err := s.db.Run(s.ctx, "EXPLAIN "+s.selectQ.String(), "testhost", "/v1/a.txt")
+	if err != nil {
+		t.Fatalf("EXPLAIN: %v", err)
+	}
+	var plan []string
+	if err := rss[0].Do(false, func(data []any) (bool, error) {
+		plan = append(plan, data[0].(string))
+		return true, nil
+	}); err != nil {
+		t.Fatalf("iterate plan: %v", err)
+	}
+	if !strings.Contains(strings.Join(plan, "\n"), `using index "files_filename"`) {
+		t.Fatalf("lookup plan does not use files_filename:\n%s", strings.Join(plan, "\n"))
+	}
+}
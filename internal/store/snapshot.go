@@ -0,0 +1,156 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"modernc.org/ql"
+)
+
+// stampName is the file, next to a cached snapshot, recording the size and
+// mtime the database had when the snapshot was copied.
+const stampName = "stamp"
+
+// racyWindow is how long after a database's last change a snapshot of it is
+// still copied afresh by every reader. A commit within the same mtime tick as
+// the copy would leave the stamp unchanged, so until then it cannot be trusted.
+const racyWindow = 2 * time.Second
+
+// userCacheDir locates the cache holding reusable snapshots. Tests replace it.
+var userCacheDir = os.UserCacheDir
+
+// errSnapshotBusy is returned by cachedSnapshot when another reader has the
+// cached snapshot open.
+var errSnapshotBusy = errors.New("cached snapshot in use")
+
+// cachedSnapshot returns the directory in the user's cache holding a snapshot
+// of the database at dbFile, copying the database there first unless the
+// snapshot is already current. The returned file holds an exclusive flock on
+// the directory; the caller closes it once done with the snapshot. It fails
+// with errSnapshotBusy when another reader holds the directory.
+func cachedSnapshot(dbFile string) (string, *os.File, error) {
+	dir, err := cachedDir(dbFile)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", nil, fmt.Errorf("create snapshot cache %q: %w", dir, err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return "", nil, fmt.Errorf("open snapshot cache lock: %w", err)
+	}
+	if ok, err := tryFlock(lock); err != nil || !ok {
+		_ = lock.Close()
+		if err == nil {
+			err = errSnapshotBusy
+		}
+		return "", nil, err
+	}
+
+	if err := refreshSnapshot(dbFile, filepath.Join(dir, dbName), filepath.Join(dir, stampName)); err != nil {
+		_ = lock.Close()
+		return "", nil, err
+	}
+	return dir, lock, nil
+}
+
+// cachedDir returns the cache directory for snapshots of dbFile.
+func cachedDir(dbFile string) (string, error) {
+	root, err := userCacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dbFile)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(root, "gocate", "snapshots", hex.EncodeToString(sum[:8])), nil
+}
+
+// refreshSnapshot copies the database at src to dst unless the stamp file
+// shows dst is a copy of src as it is now. It holds a shared flock on src
+// throughout, so the stamp and the copy both reflect the same commit.
+func refreshSnapshot(src, dst, stamp string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open db %q: %w", src, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := flock(f, false); err != nil {
+		return fmt.Errorf("lock db %q: %w", src, err)
+	}
+	defer func() { _ = funlock(f) }()
+
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat db %q: %w", src, err)
+	}
+	want := fmt.Sprintf("%d %d\n", st.Size(), st.ModTime().UnixNano())
+	if got, err := os.ReadFile(stamp); err == nil && string(got) == want {
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+	}
+
+	// A leftover WAL belongs to the old copy and must not be replayed onto the
+	// new one.
+	for _, name := range []string{stamp, dst, ql.WalName(dst)} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove stale snapshot: %w", err)
+		}
+	}
+	if err := copyFile(f, dst); err != nil {
+		return fmt.Errorf("snapshot db %q: %w", src, err)
+	}
+	if time.Since(st.ModTime()) < racyWindow {
+		return nil // unstamped, so the next reader copies again
+	}
+	return os.WriteFile(stamp, []byte(want), 0o600)
+}
+
+// snapshot copies the database at src to dst under a shared flock. Every
+// commit is fully applied to the database file before the writer releases its
+// exclusive lock, so the copy is consistent without the write-ahead log, which
+// only ever holds the writer's uncommitted transaction.
+func snapshot(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open db %q: %w", src, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := flock(f, false); err != nil {
+		return fmt.Errorf("lock db %q: %w", src, err)
+	}
+	defer func() { _ = funlock(f) }()
+
+	if err := copyFile(f, dst); err != nil {
+		return fmt.Errorf("snapshot db %q: %w", src, err)
+	}
+	return nil
+}
+
+// copyFile copies the contents of src into a new file at dst.
+func copyFile(src *os.File, dst string) (err error) {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(out, src)
+	return err
+}
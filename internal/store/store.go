@@ -1,28 +1,104 @@
 // Package store provides persistent storage for gocate's file index.
 //
-// It wraps an embedded modernc.org/ql database holding a single "files" table
-// keyed conceptually by (hostname, filename). Callers get and put FileInfo
-// values; all SQL and result-set handling stays inside this package.
+// It wraps an embedded modernc.org/ql database holding a "files" table keyed
+// conceptually by (hostname, filename), a "runs" table recording each indexing
+// run, an optional "history" of file changes, and a "meta" table recording the
+// schema version; see migrations for how the schema evolves. Callers get and
+// put FileInfo values; all SQL and result-set handling stays inside this
+// package.
+//
+// A database has at most one writer (Open). Any number of readers
+// (OpenReadOnly) can run alongside it: each works on a snapshot, reused from
+// the user's cache while the database is unchanged, and the writer holds an
+// exclusive flock on the database file while committing so a snapshot never
+// captures a half-applied transaction.
 package store
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"iter"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"modernc.org/ql"
 )
 
-// FileInfo describes one indexed file.
+// dbName is the database file name within the config dir.
+const dbName = "files.db"
+
+// ErrReadOnly is returned by write methods on a Store opened with OpenReadOnly.
+var ErrReadOnly = errors.New("store is read-only")
+
+// AllHosts, passed as the host to Search, Dump or Duplicates, selects rows from
+// every host rather than one.
+const AllHosts = "all"
+
+// FileInfo describes one indexed file. The stat fields after the hashes are
+// zero when unknown: for rows indexed before they were recorded, and on
+// platforms that lack them.
 type FileInfo struct {
+	Host     string // host the file was indexed on
 	Path     string
 	Size     int64
 	ModTime  time.Time
 	Imohash  string // primary hash: fast, samples the file, can collide
-	XXH3Hash string // full-content hash: treated as collision-free, used for dupes
+	Hash     string // full-content digest: treated as collision-free, used for dupes
+	HashAlgo string // name of the algorithm that computed Hash
+
+	Type       FileType
+	Mode       fs.FileMode // permission and type bits, as reported by Lstat
+	UID, GID   uint32
+	Inode      uint64
+	Device     uint64 // ID of the device holding the file
+	Nlink      uint64 // number of hard links
+	ChangeTime time.Time
+}
+
+// FileType is the kind of a filesystem entry.
+type FileType string
+
+// File types. Rows indexed before types were recorded have the empty type.
+const (
+	TypeFile    FileType = "file"
+	TypeDir     FileType = "dir"
+	TypeSymlink FileType = "symlink"
+	TypeFIFO    FileType = "fifo"
+	TypeSocket  FileType = "socket"
+	TypeDevice  FileType = "device" // block or character device
+	TypeOther   FileType = "other"
+)
+
+// TypeOf returns the type of an entry with mode m.
+func TypeOf(m fs.FileMode) FileType {
+	switch {
+	case m.IsRegular():
+		return TypeFile
+	case m.IsDir():
+		return TypeDir
+	case m&fs.ModeSymlink != 0:
+		return TypeSymlink
+	case m&fs.ModeNamedPipe != 0:
+		return TypeFIFO
+	case m&fs.ModeSocket != 0:
+		return TypeSocket
+	case m&fs.ModeDevice != 0:
+		return TypeDevice
+	default:
+		return TypeOther
+	}
+}
+
+// Unchanged reports whether fi has the same size, mtime and inode as old, the
+// signals the indexer uses to decide a file need not be hashed again. An
+// unknown (zero) inode on either side is not treated as a change.
+func (fi FileInfo) Unchanged(old FileInfo) bool {
+	return fi.Size == old.Size && fi.ModTime.Equal(old.ModTime) &&
+		(fi.Inode == 0 || old.Inode == 0 || fi.Inode == old.Inode)
 }
 
 // Store is a handle to the file index database. Its methods are safe for
@@ -34,231 +110,740 @@ type Store struct {
 	ctx      *ql.TCtx
 	hostname string
 
+	lockf     *os.File // database file, flocked exclusively around commits (writers only)
+	readOnly  bool
+	tmpDir    string   // holds a private snapshot (readers only)
+	cacheLock *os.File // flocked while a cached snapshot is open (readers only)
+
 	insertQ ql.List
 	selectQ ql.List
-	updateQ ql.List
+
+	// replaced holds rows changed in the open transaction, keyed by path. See
+	// applyReplaced. Guarded by mu.
+	replaced map[string]replacement
+
+	// historyRun is the run file changes are recorded under in the history
+	// table, 0 while history is off. See RecordHistory. Guarded by mu.
+	historyRun int64
 
 	mu sync.Mutex
 }
 
-// Open opens (creating if needed) the file index database under dir. If
-// hostname is empty it is resolved from os.Hostname, falling back to "unknown".
-func Open(dir, hostname string) (*Store, error) {
-	if hostname == "" {
-		hn, err := os.Hostname()
-		if err != nil {
-			hn = "unknown"
-		}
-		hostname = hn
-	}
+// replacement is a changed row waiting to be written: id is the row it
+// replaces, fi the new contents.
+type replacement struct {
+	id int64
+	fi FileInfo
+}
 
+// Open opens (creating if needed) the file index database under dir for
+// reading and writing. If hostname is empty it is resolved from os.Hostname,
+// falling back to "unknown".
+func Open(dir, hostname string) (*Store, error) {
 	if err := os.MkdirAll(dir, 0o775); err != nil {
 		return nil, fmt.Errorf("create config dir %q: %w", dir, err)
 	}
 
-	dbFile := filepath.Join(dir, "files.db")
+	dbFile := filepath.Join(dir, dbName)
 	db, err := ql.OpenFile(dbFile, &ql.Options{CanCreate: true, FileFormat: 2})
 	if err != nil {
 		return nil, fmt.Errorf("open db %q: %w", dbFile, err)
 	}
+	lockf, err := os.Open(dbFile)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("open db lock %q: %w", dbFile, err)
+	}
 
-	s := &Store{db: db, ctx: ql.NewRWCtx(), hostname: hostname}
+	s := &Store{db: db, ctx: ql.NewRWCtx(), hostname: resolveHostname(hostname), lockf: lockf}
 
-	if _, _, err := db.Run(s.ctx, `
-		BEGIN TRANSACTION;
-			CREATE TABLE IF NOT EXISTS files (
-				hostname string,
-				filename string,
-				size int64,
-				modtimestamp time,
-				imohash string,
-				xxh3hash string,
-			);
-		COMMIT;`); err != nil {
-		_ = db.Close()
-		return nil, fmt.Errorf("create table: %w", err)
+	if err := s.migrate(migrations); err != nil {
+		_ = s.closeDB()
+		return nil, err
 	}
 
 	if err := s.compileQueries(); err != nil {
-		_ = db.Close()
+		_ = s.closeDB()
 		return nil, err
 	}
 
 	return s, nil
 }
 
-// compileQueries precompiles the per-row statements used during indexing. The
-// hostname is embedded as a literal: it is derived from the host, never from
-// untrusted search input.
+// OpenReadOnly opens the file index database under dir for searching only. It
+// never creates or modifies anything under dir, so it works when dir is not
+// writable, and it does not contend with a concurrent Open for the database's
+// lock. Instead it reads a snapshot: the one kept in the user's cache if the
+// database has not changed since it was taken, otherwise a fresh copy, made
+// while holding a shared flock so it cannot interleave with a writer's commit.
+// A reader that finds the cached snapshot in use by another copies the
+// database to a private snapshot, removed on Close. Either way the snapshot
+// reflects the last committed state; write methods return ErrReadOnly. A
+// database that does not exist yet, nothing having been indexed, reads as an
+// empty one.
+func OpenReadOnly(dir, hostname string) (*Store, error) {
+	dbFile := filepath.Join(dir, dbName)
+	s := &Store{ctx: ql.NewRWCtx(), hostname: resolveHostname(hostname)}
+
+	if cache, lock, err := cachedSnapshot(dbFile); err == nil {
+		if err := s.openSnapshot(filepath.Join(cache, dbName), false); err == nil {
+			s.cacheLock = lock
+			return s, nil
+		}
+		// Make the next reader copy the database again rather than trip over
+		// the same unusable snapshot.
+		_ = os.Remove(filepath.Join(cache, stampName))
+		_ = lock.Close()
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gocate-")
+	if err != nil {
+		return nil, fmt.Errorf("create snapshot dir: %w", err)
+	}
+	snapFile := filepath.Join(tmpDir, dbName)
+	missing := false
+	if err := snapshot(dbFile, snapFile); errors.Is(err, fs.ErrNotExist) {
+		missing = true // the snapshot starts empty
+	} else if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	if err := s.openSnapshot(snapFile, missing); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("open db snapshot of %q: %w", dbFile, err)
+	}
+	s.tmpDir = tmpDir
+	return s, nil
+}
+
+// openSnapshot opens the snapshot at snapFile as s's database and marks s
+// read-only. The snapshot belongs to this reader, so an older schema can be
+// upgraded in place first.
+func (s *Store) openSnapshot(snapFile string, canCreate bool) error {
+	db, err := ql.OpenFile(snapFile, &ql.Options{CanCreate: canCreate, FileFormat: 2, RemoveEmptyWAL: true})
+	if err != nil {
+		return err
+	}
+	s.db = db
+	if err := s.migrate(migrations); err != nil {
+		_ = db.Close()
+		return err
+	}
+	s.readOnly = true
+	if err := s.compileQueries(); err != nil {
+		_ = db.Close()
+		return err
+	}
+	return nil
+}
+
+// resolveHostname returns hostname, or os.Hostname if it is empty, falling back
+// to "unknown".
+func resolveHostname(hostname string) string {
+	if hostname != "" {
+		return hostname
+	}
+	hn, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hn
+}
+
+// compileQueries precompiles the per-row statements used during indexing. Every
+// statement is keyed by (hostname, filename), bound as $1 and $2, so one
+// host's rows are never read or rewritten on behalf of another. The write
+// statements carry no transaction of their own; callers wrap them with inTx or
+// run them inside a Batch.
 func (s *Store) compileQueries() error {
 	var err error
 
 	if s.insertQ, err = ql.Compile(fmt.Sprintf(`
-		BEGIN TRANSACTION;
-			INSERT INTO files VALUES("%s", $1, $2, $3, $4, $5);
-		COMMIT;`, s.hostname)); err != nil {
+		INSERT INTO files (%s) VALUES(%s);`, fileColumns, placeholders(len(fileArgs("", FileInfo{}))))); err != nil {
 		return fmt.Errorf("compile insert: %w", err)
 	}
 
+	// ql's planner uses one single-column index per query, so the filename
+	// condition comes first to steer it to files_filename.
 	if s.selectQ, err = ql.Compile(fmt.Sprintf(`
-		SELECT * FROM files WHERE hostname == "%s" && filename == $1;`, s.hostname)); err != nil {
+		SELECT id() AS id, %s FROM files WHERE filename == $2 && hostname == $1;`, fileColumns)); err != nil {
 		return fmt.Errorf("compile select: %w", err)
 	}
 
-	if s.updateQ, err = ql.Compile(fmt.Sprintf(`
-		BEGIN TRANSACTION;
-			UPDATE files SET
-				hostname = "%s",
-				size = $2,
-				modtimestamp = $3,
-				imohash = $4,
-				xxh3hash = $5
-			WHERE filename = $1;
-		COMMIT;`, s.hostname)); err != nil {
-		return fmt.Errorf("compile update: %w", err)
+	return nil
+}
+
+// inTx runs fn inside a transaction, committing if it succeeds and rolling
+// back otherwise. Callers must hold s.mu.
+func (s *Store) inTx(fn func() error) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		_ = s.rollback()
+		return err
 	}
+	return s.commit()
+}
 
+// begin, commit and rollback manage a transaction on s.ctx. Callers must hold
+// s.mu. On a read-only store begin fails with ErrReadOnly, which is what keeps
+// every write method from touching the snapshot.
+func (s *Store) begin() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if _, _, err := s.db.Run(s.ctx, "BEGIN TRANSACTION;"); err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
 	return nil
 }
 
-// Close flushes and closes the underlying database.
+func (s *Store) commit() error {
+	if err := s.applyReplaced(); err != nil {
+		return err
+	}
+	return s.exclusive(func() error {
+		if _, _, err := s.db.Run(s.ctx, "COMMIT;"); err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Store) rollback() error {
+	clear(s.replaced)
+	if _, _, err := s.db.Run(s.ctx, "ROLLBACK;"); err != nil {
+		return fmt.Errorf("rollback: %w", err)
+	}
+	return nil
+}
+
+// exclusive runs fn, which may write to the database file, while holding an
+// exclusive flock on it so OpenReadOnly never copies a half-written file. It
+// then bumps the file's mtime: writes through ql's memory map need not update
+// it, and readers rely on it to tell a cached snapshot is stale.
+func (s *Store) exclusive(fn func() error) error {
+	if s.lockf == nil {
+		return fn()
+	}
+	if err := flock(s.lockf, true); err != nil {
+		return fmt.Errorf("lock db: %w", err)
+	}
+	defer func() { _ = funlock(s.lockf) }()
+	err := fn()
+	if terr := os.Chtimes(s.lockf.Name(), time.Time{}, time.Now()); terr != nil && err == nil {
+		err = fmt.Errorf("touch db: %w", terr)
+	}
+	return err
+}
+
+// Close flushes and closes the underlying database. For a read-only store it
+// also removes a private snapshot or releases the cached one.
 func (s *Store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.db.Flush(); err != nil {
-		return fmt.Errorf("flush db: %w", err)
+	if !s.readOnly {
+		if err := s.exclusive(s.db.Flush); err != nil {
+			_ = s.closeDB()
+			return fmt.Errorf("flush db: %w", err)
+		}
 	}
-	if err := s.db.Close(); err != nil {
+	return s.closeDB()
+}
+
+// closeDB closes the database and releases the lock file or snapshot.
+func (s *Store) closeDB() error {
+	err := s.exclusive(s.db.Close)
+	if s.lockf != nil {
+		_ = s.lockf.Close()
+	}
+	if s.tmpDir != "" {
+		_ = os.RemoveAll(s.tmpDir)
+	}
+	if s.cacheLock != nil {
+		_ = s.cacheLock.Close()
+	}
+	if err != nil {
 		return fmt.Errorf("close db: %w", err)
 	}
 	return nil
 }
 
+// Hostname returns the host this store reads and writes rows for by default.
+func (s *Store) Hostname() string {
+	return s.hostname
+}
+
+// hostArg resolves a host filter for queries written as
+// ($1 == "" || hostname == $1): "" means this store's host, and AllHosts
+// becomes "" so the condition matches every row.
+func (s *Store) hostArg(host string) string {
+	switch host {
+	case "":
+		return s.hostname
+	case AllHosts:
+		return ""
+	}
+	return host
+}
+
+// Equal reports whether fi and o, rows for the same path and host, record
+// identical values, so rewriting one with the other would change nothing.
+func (fi FileInfo) Equal(o FileInfo) bool {
+	return fi.Size == o.Size && fi.ModTime.Equal(o.ModTime) &&
+		fi.Imohash == o.Imohash && fi.Hash == o.Hash && fi.HashAlgo == o.HashAlgo &&
+		fi.Type == o.Type && fi.Mode == o.Mode && fi.UID == o.UID && fi.GID == o.GID &&
+		fi.Inode == o.Inode && fi.Device == o.Device && fi.Nlink == o.Nlink &&
+		fi.ChangeTime.Equal(o.ChangeTime)
+}
+
 // Has reports whether a row already exists for path on this host. It is used by
 // quick (incremental) indexing to skip files already recorded.
 func (s *Store) Has(path string) (bool, error) {
+	_, ok, err := s.Lookup(path)
+	return ok, err
+}
+
+// Lookup returns the row for path on this host, if there is one.
+func (s *Store) Lookup(path string) (FileInfo, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	fr, err := s.firstRow(path)
-	if err != nil {
-		return false, err
-	}
-	return len(fr) != 0, nil
+	fi, _, ok, err := s.lookup(path)
+	return fi, ok, err
 }
 
-// firstRow returns the existing row for path (empty if none). Callers must hold s.mu.
-func (s *Store) firstRow(path string) ([]any, error) {
-	rs, _, err := s.db.Execute(s.ctx, s.selectQ, path)
+// lookup returns the current row for path, if any, and its row id. A row
+// changed earlier in the open transaction is returned with its new contents.
+// Callers must hold s.mu.
+func (s *Store) lookup(path string) (FileInfo, int64, bool, error) {
+	if r, ok := s.replaced[path]; ok {
+		return r.fi, r.id, true, nil
+	}
+
+	rs, _, err := s.db.Execute(s.ctx, s.selectQ, s.hostname, path)
 	if err != nil {
-		return nil, fmt.Errorf("select %q: %w", path, err)
+		return FileInfo{}, 0, false, fmt.Errorf("select %q: %w", path, err)
 	}
 	fr, err := rs[0].FirstRow()
 	if err != nil {
-		return nil, fmt.Errorf("first row %q: %w", path, err)
+		return FileInfo{}, 0, false, fmt.Errorf("first row %q: %w", path, err)
+	}
+	if fr == nil {
+		return FileInfo{}, 0, false, nil
 	}
-	return fr, nil
+	cols, err := fieldsOf(rs[0])
+	if err != nil {
+		return FileInfo{}, 0, false, fmt.Errorf("select %q: %w", path, err)
+	}
+	return cols.file(fr), value[int64](cols, fr, "id"), true, nil
 }
 
 // Upsert inserts fi if no row exists for its path, otherwise updates the row
-// when a hash has changed. When quick is true, existing rows are left untouched.
+// when anything recorded about the file has changed, metadata as well as
+// hashes. When quick is true, existing rows are left untouched.
+// Each call commits its own transaction; use a Batch for bulk writes, since
+// every commit that changes existing rows costs one scan of the table.
 func (s *Store) Upsert(fi FileInfo, quick bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	fr, err := s.firstRow(fi.Path)
-	if err != nil {
+	return s.inTx(func() error {
+		_, err := s.upsert(fi, quick)
 		return err
+	})
+}
+
+// write is what an upsert did to the table.
+type write int
+
+const (
+	unchanged write = iota
+	inserted
+	updated
+)
+
+// upsert implements Upsert inside the caller's transaction. New rows are
+// inserted straight away; changed rows are queued for applyReplaced. Callers
+// must hold s.mu.
+func (s *Store) upsert(fi FileInfo, quick bool) (write, error) {
+	old, id, ok, err := s.lookup(fi.Path)
+	if err != nil {
+		return unchanged, err
 	}
 
 	// No existing row: insert.
-	if len(fr) == 0 {
-		if _, _, err := s.db.Execute(s.ctx, s.insertQ,
-			fi.Path, fi.Size, fi.ModTime, fi.Imohash, fi.XXH3Hash); err != nil {
-			return fmt.Errorf("insert %q: %w", fi.Path, err)
+	if !ok {
+		if err := s.recordChange(Added, fi); err != nil {
+			return unchanged, err
 		}
-		return nil
+		return inserted, s.insert(fi)
+	}
+
+	// Existing row: in quick mode leave it alone; otherwise update if it changed.
+	if quick || old.Equal(fi) {
+		return unchanged, nil
 	}
+	if contentChanged(old, fi) {
+		if err := s.recordChange(Modified, old); err != nil {
+			return unchanged, err
+		}
+	}
+	if s.replaced == nil {
+		s.replaced = make(map[string]replacement)
+	}
+	s.replaced[fi.Path] = replacement{id: id, fi: fi}
+	return updated, nil
+}
 
-	// Existing row: in quick mode leave it alone; otherwise update if a hash changed.
-	// Columns: 0 hostname, 1 filename, 2 size, 3 modtimestamp, 4 imohash, 5 xxh3hash.
-	if quick {
+// insert adds a row for fi on this host. Callers must hold s.mu.
+func (s *Store) insert(fi FileInfo) error {
+	if _, _, err := s.db.Execute(s.ctx, s.insertQ, fileArgs(s.hostname, fi)...); err != nil {
+		return fmt.Errorf("insert %q: %w", fi.Path, err)
+	}
+	return nil
+}
+
+// applyReplaced writes the rows changed in the open transaction. ql's UPDATE
+// and DELETE never use an index, since rows form a singly linked list that must
+// be walked to unlink one, so changing rows one at a time would scan the table
+// once per row. Instead all replaced rows are deleted in a single scan and
+// inserted again with their new contents. Callers must hold s.mu.
+func (s *Store) applyReplaced() error {
+	if len(s.replaced) == 0 {
 		return nil
 	}
-	if fr[4] != fi.Imohash || fr[5] != fi.XXH3Hash {
-		if _, _, err := s.db.Execute(s.ctx, s.updateQ,
-			fi.Path, fi.Size, fi.ModTime, fi.Imohash, fi.XXH3Hash); err != nil {
-			return fmt.Errorf("update %q: %w", fi.Path, err)
+
+	ids := make([]int64, 0, len(s.replaced))
+	for _, r := range s.replaced {
+		ids = append(ids, r.id)
+	}
+	if err := s.deleteIDs(ids); err != nil {
+		return err
+	}
+	for _, r := range s.replaced {
+		if err := s.insert(r.fi); err != nil {
+			return err
 		}
 	}
+	clear(s.replaced)
 	return nil
 }
 
-// Search returns files whose filename matches the given pattern. The pattern is
-// a regular expression: ql's LIKE operator is regex-based, not SQL globbing.
-func (s *Store) Search(pattern string) ([]FileInfo, error) {
+// deleteIDs deletes the files rows with the given ids in one table scan. The
+// ids are staged in the doomed table because ql evaluates IN (SELECT ...) as
+// a set lookup, while a literal IN list is compared element by element for
+// every row. It must run inside a transaction. Callers must hold s.mu.
+func (s *Store) deleteIDs(ids []int64) error {
+	for _, id := range ids {
+		if _, _, err := s.db.Run(s.ctx, "INSERT INTO doomed VALUES($1);", id); err != nil {
+			return fmt.Errorf("stage row %d for delete: %w", id, err)
+		}
+	}
+	if _, _, err := s.db.Run(s.ctx, `
+		DELETE FROM files WHERE id() IN (SELECT id FROM doomed);
+		TRUNCATE TABLE doomed;`); err != nil {
+		return fmt.Errorf("delete rows: %w", err)
+	}
+	return nil
+}
+
+// Paths returns the filenames recorded for this host at or below root.
+func (s *Store) Paths(root string) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	rss, _, err := s.db.Run(s.ctx, "SELECT * FROM files WHERE filename LIKE $1;", pattern)
+	end, prefix := subtree(root)
+	rss, _, err := s.db.Run(s.ctx, `
+		SELECT filename FROM files
+		WHERE filename >= $2 && filename < $3 && hostname == $1
+			&& (filename == $2 || hasPrefix(filename, $4));`,
+		s.hostname, root, end, prefix)
 	if err != nil {
-		return nil, fmt.Errorf("search %q: %w", pattern, err)
+		return nil, fmt.Errorf("select paths under %q: %w", root, err)
+	}
+
+	var out []string
+	for _, rs := range rss {
+		if err := rs.Do(false, func(data []any) (bool, error) {
+			filename, _ := data[0].(string)
+			out = append(out, filename)
+			return true, nil
+		}); err != nil {
+			return nil, fmt.Errorf("iterate paths: %w", err)
+		}
 	}
-	return collectFiles(rss)
+	return out, nil
 }
 
-// Dump returns every row in the index.
-func (s *Store) Dump() ([]FileInfo, error) {
+// UnderSeq yields the rows recorded for this host at or below root, in
+// filename order.
+func (s *Store) UnderSeq(root string) iter.Seq2[FileInfo, error] {
+	end, prefix := subtree(root)
+	return s.files(fmt.Sprintf("select files under %q", root), `
+		SELECT * FROM files
+		WHERE filename >= $2 && filename < $3 && hostname == $1
+			&& (filename == $2 || hasPrefix(filename, $4))
+		ORDER BY filename;`,
+		s.hostname, root, end, prefix)
+}
+
+// FilesAfter returns up to n of this host's rows whose filename sorts after
+// after, in filename order, so a long pass over the table can be done in
+// pages and resumed from the last path it handled. The order is explicit
+// rather than left to whichever index ql's planner picks; files_filename
+// still narrows each page's sort to the rows after after.
+func (s *Store) FilesAfter(after string, n int) ([]FileInfo, error) {
+	return collect(s.files(fmt.Sprintf("select files after %q", after), `
+		SELECT * FROM files
+		WHERE filename > $2 && hostname == $1
+		ORDER BY filename
+		LIMIT $3;`,
+		s.hostname, after, int64(n)))
+}
+
+// subtree returns the bounds of a query for the filenames at or below root.
+// Everything at or below root sorts in [root, end), end being root+"0", since
+// '0' follows the separator. The range lets files_filename narrow the scan;
+// matching prefix then drops siblings such as root+".bak" that fall inside it.
+func subtree(root string) (end, prefix string) {
+	sep := string(filepath.Separator)
+	base := strings.TrimSuffix(root, sep)
+	return base + string(rune(filepath.Separator+1)), base + sep
+}
+
+// Delete removes the rows for paths on this host. All deletions are applied in
+// a single transaction: either every row is removed or none is.
+func (s *Store) Delete(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	rss, _, err := s.db.Run(s.ctx, "SELECT * FROM files;")
-	if err != nil {
-		return nil, fmt.Errorf("dump: %w", err)
+	return s.inTx(func() error {
+		ids := make([]int64, 0, len(paths))
+		for _, path := range paths {
+			old, id, ok, err := s.lookup(path)
+			if err != nil {
+				return err
+			}
+			if ok {
+				ids = append(ids, id)
+				if err := s.recordChange(Deleted, old); err != nil {
+					return err
+				}
+			}
+			delete(s.replaced, path)
+		}
+		return s.deleteIDs(ids)
+	})
+}
+
+// Search returns host's files whose filename matches the given pattern. The
+// pattern is a regular expression: ql's LIKE operator is regex-based, not SQL
+// globbing. host is a hostname, "" for this store's host, or AllHosts.
+func (s *Store) Search(host, pattern string) ([]FileInfo, error) {
+	return collect(s.SearchSeq(host, pattern))
+}
+
+// SearchSeq is the streaming form of Search: rows are yielded as the query
+// finds them, and the query stops as soon as the loop body breaks. The store
+// stays locked until iteration ends, so the loop body must not call other
+// Store methods; the same holds for DumpSeq and DuplicatesSeq.
+func (s *Store) SearchSeq(host, pattern string) iter.Seq2[FileInfo, error] {
+	return s.files(fmt.Sprintf("search %q", pattern), `
+		SELECT * FROM files
+		WHERE ($1 == "" || hostname == $1) && filename LIKE $2;`,
+		s.hostArg(host), pattern)
+}
+
+// Dump returns every row for host ("" for this store's host, or AllHosts).
+func (s *Store) Dump(host string) ([]FileInfo, error) {
+	return collect(s.DumpSeq(host))
+}
+
+// DumpSeq is the streaming form of Dump.
+func (s *Store) DumpSeq(host string) iter.Seq2[FileInfo, error] {
+	return s.files("dump", `
+		SELECT * FROM files WHERE $1 == "" || hostname == $1;`,
+		s.hostArg(host))
+}
+
+// DupGroup is a set of files with identical content: the same size and
+// content digest. Paths hard-linked to one
+// inode hold a single copy of the content between them, so they are collapsed
+// into one entry of Copies; only the copies beyond the first take up
+// reclaimable space. Each copy's links are sorted by path, then host, and
+// copies by their first link, so the first link of the first copy is a stable
+// canonical original.
+type DupGroup struct {
+	Hash   string       // the shared content digest
+	Algo   string       // the algorithm that computed Hash
+	Size   int64        // size of each copy
+	Copies [][]FileInfo // paths grouped by (host, device, inode)
+}
+
+// Reclaimable returns the bytes that hard-linking every copy to the first
+// would free.
+func (g DupGroup) Reclaimable() int64 {
+	return int64(len(g.Copies)-1) * g.Size
+}
+
+// Duplicates returns groups of host's files ("" for this store's host, or
+// AllHosts) that share a size and content digest. Only groups holding more than one
+// copy are returned, so files that are all hard links of each other are not
+// reported. Files with an empty hash (e.g. indexed with -no-hash, or
+// zero-byte) are ignored. Digests of different algorithms are never compared:
+// only rows hashed with DupAlgo's algorithm are grouped. Groups come in hash
+// and size order, so the output is stable across runs.
+func (s *Store) Duplicates(host string) ([]DupGroup, error) {
+	return collect(s.DuplicatesSeq(host))
+}
+
+// DuplicatesSeq is the streaming form of Duplicates. Rows arrive sorted by
+// hash and size, so each group is yielded as soon as the next hash or size
+// starts and only one group is held in memory at a time. Files of different
+// sizes are never grouped, even when a weak digest collides.
+func (s *Store) DuplicatesSeq(host string) iter.Seq2[DupGroup, error] {
+	return func(yield func(DupGroup, error) bool) {
+		algo, err := s.DupAlgo(host)
+		if err != nil || algo == "" {
+			if err != nil {
+				yield(DupGroup{}, err)
+			}
+			return
+		}
+
+		// hash > "" skips unhashed rows through files_hash.
+		rows := s.files("select for dupes", `
+			SELECT hostname, filename, size, hash, hashalgo, inode, device, nlink FROM files
+			WHERE hash > "" && hashalgo == $2 && ($1 == "" || hostname == $1)
+			ORDER BY hash, size, filename, hostname;`,
+			s.hostArg(host), algo)
+
+		var group []FileInfo
+		for fi, err := range rows {
+			if err != nil {
+				yield(DupGroup{}, err)
+				return
+			}
+			if len(group) > 0 && (fi.Hash != group[0].Hash || fi.Size != group[0].Size) {
+				if g := dupGroup(group); len(g.Copies) > 1 && !yield(g, nil) {
+					return
+				}
+				group = nil
+			}
+			group = append(group, fi)
+		}
+		if g := dupGroup(group); len(g.Copies) > 1 {
+			yield(g, nil)
+		}
 	}
-	return collectFiles(rss)
 }
 
-// Duplicates returns groups of filenames that share an xxh3 content hash. Only
-// groups with more than one file are returned. Files with an empty hash (e.g.
-// indexed with -no-hash, or zero-byte) are ignored.
-func (s *Store) Duplicates() ([][]string, error) {
+// HashAlgos returns how many of host's rows ("" for this store's host, or
+// AllHosts) have a digest from each hash algorithm.
+func (s *Store) HashAlgos(host string) (map[string]int64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	rss, _, err := s.db.Run(s.ctx, "SELECT filename, xxh3hash FROM files;")
+	rss, _, err := s.db.Run(s.ctx, `
+		SELECT hashalgo, count(*) FROM files
+		WHERE hash > "" && ($1 == "" || hostname == $1)
+		GROUP BY hashalgo;`,
+		s.hostArg(host))
 	if err != nil {
-		return nil, fmt.Errorf("select for dupes: %w", err)
+		return nil, fmt.Errorf("count hash algorithms: %w", err)
+	}
+	algos := make(map[string]int64)
+	if err := rss[0].Do(false, func(data []any) (bool, error) {
+		algo, _ := data[0].(string)
+		n, _ := data[1].(int64)
+		algos[algo] = n
+		return true, nil
+	}); err != nil {
+		return nil, fmt.Errorf("count hash algorithms: %w", err)
 	}
+	return algos, nil
+}
 
-	byHash := make(map[string][]string)
-	for _, rs := range rss {
-		if err := rs.Do(false, func(data []any) (bool, error) {
-			filename, _ := data[0].(string)
-			hash, _ := data[1].(string)
-			if hash == "" {
-				return true, nil
+// DupAlgo returns the algorithm Duplicates compares digests of: the one most
+// of host's hashed rows use, ties going to the first name in order. It returns
+// "" if no row is hashed.
+func (s *Store) DupAlgo(host string) (string, error) {
+	algos, err := s.HashAlgos(host)
+	if err != nil {
+		return "", err
+	}
+	best := ""
+	for algo, n := range algos {
+		if best == "" || n > algos[best] || n == algos[best] && algo < best {
+			best = algo
+		}
+	}
+	return best, nil
+}
+
+// SizeCollisions yields groups of this host's regular files that share a
+// non-zero size, the only files that can have duplicates. Rows indexed before
+// types were recorded may be regular files too, so they are included; callers
+// must check what such a file is before reading it. Groups come in size order
+// and their members in path order. Like DuplicatesSeq, it keeps the store
+// locked until iteration ends.
+func (s *Store) SizeCollisions() iter.Seq2[[]FileInfo, error] {
+	rows := s.files("select size collisions", `
+		SELECT * FROM files
+		WHERE hostname == $1 && (filetype IS NULL || filetype == "" || filetype == $2) && size > 0
+		ORDER BY size, filename;`,
+		s.hostname, string(TypeFile))
+
+	return func(yield func([]FileInfo, error) bool) {
+		var group []FileInfo
+		for fi, err := range rows {
+			if err != nil {
+				yield(nil, err)
+				return
 			}
-			byHash[hash] = append(byHash[hash], filename)
-			return true, nil
-		}); err != nil {
-			return nil, fmt.Errorf("iterate dupes: %w", err)
+			if len(group) > 0 && fi.Size != group[0].Size {
+				if len(group) > 1 && !yield(group, nil) {
+					return
+				}
+				group = nil
+			}
+			group = append(group, fi)
+		}
+		if len(group) > 1 {
+			yield(group, nil)
 		}
 	}
+}
 
-	var groups [][]string
-	for _, files := range byHash {
-		if len(files) > 1 {
-			sort.Strings(files)
-			groups = append(groups, files)
+// dupGroup collapses files sharing a size and content hash, in path order, into
+// copies. A file whose inode is unknown is taken to be a copy of its own.
+func dupGroup(files []FileInfo) DupGroup {
+	if len(files) == 0 {
+		return DupGroup{}
+	}
+	type key struct {
+		host          string
+		device, inode uint64
+	}
+	g := DupGroup{Hash: files[0].Hash, Algo: files[0].HashAlgo, Size: files[0].Size}
+	copyOf := make(map[key]int, len(files))
+	for _, fi := range files {
+		k := key{fi.Host, fi.Device, fi.Inode}
+		if i, ok := copyOf[k]; ok && fi.Inode != 0 {
+			g.Copies[i] = append(g.Copies[i], fi)
+			continue
 		}
+		copyOf[k] = len(g.Copies)
+		g.Copies = append(g.Copies, []FileInfo{fi})
 	}
-	// Deterministic group order so script output is stable across runs.
-	sort.Slice(groups, func(i, j int) bool {
-		return groups[i][0] < groups[j][0]
-	})
-	return groups, nil
+	return g
 }
 
 // Info returns the database name and the list of table names.
@@ -276,23 +861,51 @@ func (s *Store) Info() (name string, tables []string, err error) {
 	return info.Name, tables, nil
 }
 
-// collectFiles materializes "SELECT *" result sets into FileInfo values.
-// Columns: 0 hostname, 1 filename, 2 size, 3 modtimestamp, 4 imohash, 5 xxh3hash.
-func collectFiles(rss []ql.Recordset) ([]FileInfo, error) {
-	var out []FileInfo
-	for _, rs := range rss {
-		if err := rs.Do(false, func(data []any) (bool, error) {
-			fi := FileInfo{}
-			fi.Path, _ = data[1].(string)
-			fi.Size, _ = data[2].(int64)
-			fi.ModTime, _ = data[3].(time.Time)
-			fi.Imohash, _ = data[4].(string)
-			fi.XXH3Hash, _ = data[5].(string)
-			out = append(out, fi)
-			return true, nil
-		}); err != nil {
-			return nil, fmt.Errorf("iterate rows: %w", err)
+// files runs query and yields each row as a FileInfo, reading columns by name.
+// The store stays locked until iteration ends, so the loop body must not call
+// other Store methods. what describes the query in errors.
+func (s *Store) files(what, query string, args ...any) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		rss, _, err := s.db.Run(s.ctx, query, args...)
+		if err != nil {
+			yield(FileInfo{}, fmt.Errorf("%s: %w", what, err))
+			return
+		}
+		for _, rs := range rss {
+			cols, err := fieldsOf(rs)
+			if err != nil {
+				yield(FileInfo{}, fmt.Errorf("%s: %w", what, err))
+				return
+			}
+			stopped := false
+			if err := rs.Do(false, func(data []any) (bool, error) {
+				if !yield(cols.file(data), nil) {
+					stopped = true
+					return false, nil
+				}
+				return true, nil
+			}); err != nil {
+				yield(FileInfo{}, fmt.Errorf("%s: iterate rows: %w", what, err))
+				return
+			}
+			if stopped {
+				return
+			}
+		}
+	}
+}
+
+// collect drains seq into a slice, stopping at the first error.
+func collect[T any](seq iter.Seq2[T, error]) ([]T, error) {
+	var out []T
+	for v, err := range seq {
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, v)
 	}
 	return out, nil
 }
@@ -1,11 +1,30 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	cache, err := os.MkdirTemp("", "gocate-cache-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	userCacheDir = func() (string, error) { return cache, nil }
+	code := m.Run()
+	_ = os.RemoveAll(cache)
+	os.Exit(code)
+}
+
 func openTest(t *testing.T) *Store {
 	t.Helper()
 	s, err := Open(t.TempDir(), "testhost")
@@ -23,12 +42,12 @@ func openTest(t *testing.T) *Store {
 func TestUpsertInsertAndSearch(t *testing.T) {
 	s := openTest(t)
 
-	fi := FileInfo{Path: "/tmp/notes.md", Size: 10, ModTime: time.Unix(1, 0), Imohash: "aa", XXH3Hash: "bb"}
+	fi := FileInfo{Path: "/tmp/notes.md", Size: 10, ModTime: time.Unix(1, 0), Imohash: "aa", HashAlgo: "xxh3", Hash: "bb"}
 	if err := s.Upsert(fi, false); err != nil {
 		t.Fatalf("Upsert: %v", err)
 	}
 
-	got, err := s.Search(`\.md$`)
+	got, err := s.Search("", `\.md$`)
 	if err != nil {
 		t.Fatalf("Search: %v", err)
 	}
@@ -36,7 +55,7 @@ func TestUpsertInsertAndSearch(t *testing.T) {
 		t.Fatalf("Search returned %+v, want one row for %q", got, fi.Path)
 	}
 
-	none, err := s.Search(`\.txt$`)
+	none, err := s.Search("", `\.txt$`)
 	if err != nil {
 		t.Fatalf("Search: %v", err)
 	}
@@ -48,47 +67,47 @@ func TestUpsertInsertAndSearch(t *testing.T) {
 func TestUpsertUpdatesOnHashChange(t *testing.T) {
 	s := openTest(t)
 
-	fi := FileInfo{Path: "/tmp/f", Size: 1, ModTime: time.Unix(1, 0), Imohash: "old", XXH3Hash: "old"}
+	fi := FileInfo{Path: "/tmp/f", Size: 1, ModTime: time.Unix(1, 0), Imohash: "old", HashAlgo: "xxh3", Hash: "old"}
 	if err := s.Upsert(fi, false); err != nil {
 		t.Fatalf("Upsert insert: %v", err)
 	}
 
-	fi.Imohash, fi.XXH3Hash = "new", "new"
+	fi.Imohash, fi.Hash = "new", "new"
 	if err := s.Upsert(fi, false); err != nil {
 		t.Fatalf("Upsert update: %v", err)
 	}
 
-	got, err := s.Dump()
+	got, err := s.Dump("")
 	if err != nil {
 		t.Fatalf("Dump: %v", err)
 	}
 	if len(got) != 1 {
 		t.Fatalf("Dump returned %d rows, want 1 (update must not insert a duplicate)", len(got))
 	}
-	if got[0].XXH3Hash != "new" {
-		t.Fatalf("hash = %q, want updated value %q", got[0].XXH3Hash, "new")
+	if got[0].Hash != "new" {
+		t.Fatalf("hash = %q, want updated value %q", got[0].Hash, "new")
 	}
 }
 
 func TestUpsertQuickSkipsExisting(t *testing.T) {
 	s := openTest(t)
 
-	fi := FileInfo{Path: "/tmp/f", Size: 1, ModTime: time.Unix(1, 0), Imohash: "old", XXH3Hash: "old"}
+	fi := FileInfo{Path: "/tmp/f", Size: 1, ModTime: time.Unix(1, 0), Imohash: "old", HashAlgo: "xxh3", Hash: "old"}
 	if err := s.Upsert(fi, false); err != nil {
 		t.Fatalf("Upsert insert: %v", err)
 	}
 
 	// Quick mode should leave the existing row untouched even if hashes differ.
-	fi.Imohash, fi.XXH3Hash = "new", "new"
+	fi.Imohash, fi.Hash = "new", "new"
 	if err := s.Upsert(fi, true); err != nil {
 		t.Fatalf("Upsert quick: %v", err)
 	}
 
-	got, err := s.Dump()
+	got, err := s.Dump("")
 	if err != nil {
 		t.Fatalf("Dump: %v", err)
 	}
-	if len(got) != 1 || got[0].XXH3Hash != "old" {
+	if len(got) != 1 || got[0].Hash != "old" {
 		t.Fatalf("quick upsert changed row: %+v, want unchanged hash %q", got, "old")
 	}
 }
@@ -120,10 +139,10 @@ func TestDuplicates(t *testing.T) {
 	s := openTest(t)
 
 	rows := []FileInfo{
-		{Path: "/a", ModTime: time.Unix(1, 0), XXH3Hash: "dup"},
-		{Path: "/b", ModTime: time.Unix(1, 0), XXH3Hash: "dup"},
-		{Path: "/c", ModTime: time.Unix(1, 0), XXH3Hash: "unique"},
-		{Path: "/empty", ModTime: time.Unix(1, 0), XXH3Hash: ""}, // unhashed: ignored
+		{Path: "/a", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "dup"},
+		{Path: "/b", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "dup"},
+		{Path: "/c", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "unique"},
+		{Path: "/empty", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: ""}, // unhashed: ignored
 	}
 	for _, r := range rows {
 		if err := s.Upsert(r, false); err != nil {
@@ -131,16 +150,753 @@ func TestDuplicates(t *testing.T) {
 		}
 	}
 
-	groups, err := s.Duplicates()
+	groups, err := s.Duplicates("")
 	if err != nil {
 		t.Fatalf("Duplicates: %v", err)
 	}
 	if len(groups) != 1 {
 		t.Fatalf("got %d dup groups, want 1: %+v", len(groups), groups)
 	}
-	got := append([]string(nil), groups[0]...)
+	var got []string
+	for _, c := range groups[0].Copies {
+		got = append(got, c[0].Path)
+	}
 	sort.Strings(got)
 	if len(got) != 2 || got[0] != "/a" || got[1] != "/b" {
 		t.Fatalf("dup group = %v, want [/a /b]", got)
 	}
 }
+
+func TestPathsAndDelete(t *testing.T) {
+	s := openTest(t)
+
+	for _, p := range []string{"/data", "/data/a", "/data/sub/b", "/database", "/other/c"} {
+		if err := s.Upsert(FileInfo{Path: p, ModTime: time.Unix(1, 0)}, false); err != nil {
+			t.Fatalf("Upsert %s: %v", p, err)
+		}
+	}
+
+	got, err := s.Paths("/data")
+	if err != nil {
+		t.Fatalf("Paths: %v", err)
+	}
+	sort.Strings(got)
+	want := []string{"/data", "/data/a", "/data/sub/b"}
+	if len(got) != len(want) {
+		t.Fatalf("Paths = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Paths = %v, want %v", got, want)
+		}
+	}
+
+	if err := s.Delete([]string{"/data/a", "/data/sub/b"}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	rows, err := s.Dump("")
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Dump returned %d rows after delete, want 3: %+v", len(rows), rows)
+	}
+}
+
+func TestUnderSeq(t *testing.T) {
+	s := openTest(t)
+
+	for _, p := range []string{"/data/sub/b", "/database", "/data/a", "/other/c", "/data"} {
+		if err := s.Upsert(FileInfo{Path: p, ModTime: time.Unix(1, 0)}, false); err != nil {
+			t.Fatalf("Upsert %s: %v", p, err)
+		}
+	}
+
+	var got []string
+	for fi, err := range s.UnderSeq("/data") {
+		if err != nil {
+			t.Fatalf("UnderSeq: %v", err)
+		}
+		got = append(got, fi.Path)
+	}
+	if want := []string{"/data", "/data/a", "/data/sub/b"}; !slices.Equal(got, want) {
+		t.Fatalf("UnderSeq = %v, want %v in order", got, want)
+	}
+}
+
+func TestFilesAfterPages(t *testing.T) {
+	s := openTest(t)
+
+	want := []string{"/a", "/a/b", "/a/c", "/b", "/b.txt", "/c/d/e"}
+	for _, i := range []int{3, 0, 5, 1, 4, 2} {
+		if err := s.Upsert(FileInfo{Path: want[i], ModTime: time.Unix(1, 0)}, false); err != nil {
+			t.Fatalf("Upsert %s: %v", want[i], err)
+		}
+	}
+
+	var got []string
+	for after := ""; ; {
+		page, err := s.FilesAfter(after, 4)
+		if err != nil {
+			t.Fatalf("FilesAfter(%q): %v", after, err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, fi := range page {
+			got = append(got, fi.Path)
+		}
+		after = page[len(page)-1].Path
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("pages = %v, want %v in order", got, want)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	s := openTest(t)
+
+	if _, ok, err := s.Meta("test.key"); err != nil || ok {
+		t.Fatalf("Meta of an unset key = %v, %v", ok, err)
+	}
+	for _, v := range []string{"one", "two"} {
+		if err := s.SetMeta("test.key", v); err != nil {
+			t.Fatalf("SetMeta: %v", err)
+		}
+		if got, ok, err := s.Meta("test.key"); err != nil || !ok || got != v {
+			t.Fatalf("Meta = %q, %v, %v; want %q", got, ok, err, v)
+		}
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	if err := w.Upsert(FileInfo{Path: "/a.md", ModTime: time.Unix(1, 0)}, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	// The writer is still open: the reader must not need its lock.
+	r, err := OpenReadOnly(dir, "testhost")
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %v", err)
+	}
+	got, err := r.Search("", `\.md$`)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Search returned %+v, want the committed row", got)
+	}
+	if err := r.Upsert(FileInfo{Path: "/b.md"}, false); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Upsert on read-only store = %v, want ErrReadOnly", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// TestOpenReadOnlyReusesSnapshot checks that readers share the cached snapshot
+// while the database is unchanged, copy it again after a commit, and take a
+// private snapshot while another reader holds the cached one.
+func TestOpenReadOnlyReusesSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	dbFile := filepath.Join(dir, dbName)
+	put := func(path string) {
+		t.Helper()
+		if err := w.Upsert(FileInfo{Path: path, ModTime: time.Unix(1, 0)}, false); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+		// Age the commit past racyWindow so the snapshot can be stamped.
+		old := time.Now().Add(-time.Hour).Add(time.Duration(len(path)) * time.Second)
+		if err := os.Chtimes(dbFile, time.Time{}, old); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	search := func() (*Store, int) {
+		t.Helper()
+		r, err := OpenReadOnly(dir, "testhost")
+		if err != nil {
+			t.Fatalf("OpenReadOnly: %v", err)
+		}
+		got, err := r.Search("", ".")
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		return r, len(got)
+	}
+
+	put("/a")
+	r, n := search()
+	if n != 1 || r.tmpDir != "" {
+		t.Fatalf("first reader saw %d rows from %q, want 1 from the cache", n, r.tmpDir)
+	}
+	cache, err := cachedDir(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := filepath.Join(cache, dbName)
+
+	// A second reader while the first is open gets a private snapshot.
+	r2, n := search()
+	if n != 1 || r2.tmpDir == "" {
+		t.Fatalf("concurrent reader saw %d rows from %q, want 1 from a private snapshot", n, r2.tmpDir)
+	}
+	for _, r := range []*Store{r, r2} {
+		if err := r.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	if _, err := os.Stat(r2.tmpDir); !os.IsNotExist(err) {
+		t.Fatalf("snapshot dir %q not removed: %v", r2.tmpDir, err)
+	}
+
+	// Unchanged: the cached snapshot is reused, not copied again. The link
+	// keeps its inode from being handed to a new copy.
+	keep := filepath.Join(t.TempDir(), "keep")
+	if err := os.Link(snap, keep); err != nil {
+		t.Skipf("cannot link the cached snapshot: %v", err)
+	}
+	r, _ = search()
+	_ = r.Close()
+	before, err := os.Stat(keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.Stat(snap); err != nil || !os.SameFile(before, after) {
+		t.Fatalf("cached snapshot was copied again for an unchanged database: %v", err)
+	}
+
+	// Changed: the next reader sees the new row.
+	put("/bb")
+	r, n = search()
+	_ = r.Close()
+	if n != 2 {
+		t.Fatalf("reader after a commit saw %d rows, want 2", n)
+	}
+}
+
+func TestOpenReadOnlyMissing(t *testing.T) {
+	dir := t.TempDir()
+	r, err := OpenReadOnly(dir, "testhost")
+	if err != nil {
+		t.Fatalf("OpenReadOnly without a database: %v", err)
+	}
+	got, err := r.Search("", ".")
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Search of a missing database = %+v, %v; want nothing", got, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if r, err = OpenReadOnly(filepath.Join(dir, "none"), "testhost"); err != nil {
+		t.Fatalf("OpenReadOnly without a config dir: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("OpenReadOnly created files in the config dir: %v", entries)
+	}
+}
+
+// TestOpenReadOnlyDuringBatch checks that snapshots taken while a batch is
+// being written only ever see whole committed batches.
+func TestOpenReadOnlyDuringBatch(t *testing.T) {
+	const size, total = 10, 200
+
+	dir := t.TempDir()
+	w, err := Open(dir, "testhost")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+
+	done := make(chan error, 1)
+	go func() {
+		b := w.NewBatch(size, time.Hour)
+		for i := range total {
+			if err := b.Put(FileInfo{Path: fmt.Sprintf("/f%03d", i), ModTime: time.Unix(1, 0)}, false); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- b.Close()
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("batch: %v", err)
+			}
+			finished = true
+		default:
+		}
+
+		r, err := OpenReadOnly(dir, "testhost")
+		if err != nil {
+			t.Fatalf("OpenReadOnly: %v", err)
+		}
+		rows, err := r.Dump("")
+		if err != nil {
+			t.Fatalf("Dump: %v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if len(rows)%size != 0 {
+			t.Fatalf("snapshot saw %d rows, not a whole number of %d-row batches", len(rows), size)
+		}
+		if finished && len(rows) != total {
+			t.Fatalf("final snapshot saw %d rows, want %d", len(rows), total)
+		}
+	}
+}
+
+// TestHostsAreKeyedSeparately indexes the same path from two hosts sharing one
+// database and checks neither host's writes touch the other's row.
+func TestHostsAreKeyedSeparately(t *testing.T) {
+	dir := t.TempDir()
+	put := func(host string, fi FileInfo) {
+		t.Helper()
+		s, err := Open(dir, host)
+		if err != nil {
+			t.Fatalf("Open %s: %v", host, err)
+		}
+		if err := s.Upsert(fi, false); err != nil {
+			t.Fatalf("Upsert %s: %v", host, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close %s: %v", host, err)
+		}
+	}
+
+	put("alpha", FileInfo{Path: "/shared", Size: 1, ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "a1"})
+	put("beta", FileInfo{Path: "/shared", Size: 2, ModTime: time.Unix(2, 0), HashAlgo: "xxh3", Hash: "b1"})
+	put("beta", FileInfo{Path: "/shared", Size: 3, ModTime: time.Unix(3, 0), HashAlgo: "xxh3", Hash: "b2"})
+	put("beta", FileInfo{Path: "/copy", Size: 1, ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "a1"})
+
+	s, err := Open(dir, "alpha")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	own, err := s.Search("", "shared")
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(own) != 1 || own[0].Host != "alpha" || own[0].Hash != "a1" {
+		t.Fatalf("alpha's rows = %+v, want its own untouched row", own)
+	}
+
+	beta, err := s.Search("beta", "shared")
+	if err != nil {
+		t.Fatalf("Search beta: %v", err)
+	}
+	if len(beta) != 1 || beta[0].Hash != "b2" || beta[0].Size != 3 {
+		t.Fatalf("beta's rows = %+v, want one updated row", beta)
+	}
+
+	all, err := s.Dump(AllHosts)
+	if err != nil {
+		t.Fatalf("Dump all: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("Dump(AllHosts) returned %d rows, want 3", len(all))
+	}
+
+	// The same content on both hosts is only a duplicate across hosts.
+	if groups, err := s.Duplicates(""); err != nil || len(groups) != 0 {
+		t.Fatalf("Duplicates for one host = %v, %v; want none", groups, err)
+	}
+	groups, err := s.Duplicates(AllHosts)
+	if err != nil {
+		t.Fatalf("Duplicates all: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Copies) != 2 {
+		t.Fatalf("Duplicates(AllHosts) = %+v, want one group of 2", groups)
+	}
+}
+
+// BenchmarkLookupScaling measures per-file store latency against tables of
+// increasing size: Has, Upsert of a new path, and a batched Put that changes an
+// existing row (the re-index case, whose rows are replaced with one table scan
+// per commit). With files_filename all three should stay roughly flat as the
+// table grows. Populating the larger tables takes far longer than the
+// measurement; -short stops at 100k rows.
+func BenchmarkLookupScaling(b *testing.B) {
+	for _, rows := range []int{10_000, 100_000, 1_000_000} {
+		if testing.Short() && rows > 100_000 {
+			break
+		}
+		s := populate(b, rows)
+
+		b.Run(fmt.Sprintf("Has/rows=%d", rows), func(b *testing.B) {
+			for i := range b.N {
+				if _, err := s.Has(benchPath(i * 7919 % rows)); err != nil {
+					b.Fatalf("Has: %v", err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("UpsertNew/rows=%d", rows), func(b *testing.B) {
+			for i := range b.N {
+				fi := FileInfo{Path: fmt.Sprintf("/new/%d/%08d", rows, i), ModTime: time.Unix(1, 0)}
+				if err := s.Upsert(fi, false); err != nil {
+					b.Fatalf("Upsert: %v", err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("BatchChanged/rows=%d", rows), func(b *testing.B) {
+			batch := s.NewBatch(0, time.Hour)
+			for i := range b.N {
+				fi := FileInfo{Path: benchPath(i * 7919 % rows), ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: fmt.Sprint("changed", i)}
+				if err := batch.Put(fi, false); err != nil {
+					b.Fatalf("Put: %v", err)
+				}
+			}
+			if err := batch.Close(); err != nil {
+				b.Fatalf("Close: %v", err)
+			}
+		})
+
+		if err := s.Close(); err != nil {
+			b.Fatalf("Close: %v", err)
+		}
+	}
+}
+
+// populate returns a store holding rows files.
+func populate(b *testing.B, rows int) *Store {
+	b.Helper()
+	s, err := Open(b.TempDir(), "benchhost")
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	batch := s.NewBatch(10_000, time.Hour)
+	for i := range rows {
+		fi := FileInfo{Path: benchPath(i), Size: int64(i), ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: fmt.Sprint(i)}
+		if err := batch.Put(fi, false); err != nil {
+			b.Fatalf("Put: %v", err)
+		}
+	}
+	if err := batch.Close(); err != nil {
+		b.Fatalf("Close batch: %v", err)
+	}
+	return s
+}
+
+func benchPath(i int) string {
+	return fmt.Sprintf("/bench/%03d/%08d", i%1000, i)
+}
+
+func TestSearchSeqStopsEarly(t *testing.T) {
+	s := openTest(t)
+
+	for i := range 10 {
+		if err := s.Upsert(FileInfo{Path: fmt.Sprintf("/f%d.txt", i), ModTime: time.Unix(1, 0)}, false); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+	}
+
+	n := 0
+	for _, err := range s.SearchSeq("", `\.txt$`) {
+		if err != nil {
+			t.Fatalf("SearchSeq: %v", err)
+		}
+		if n++; n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Fatalf("iterated %d rows, want 3", n)
+	}
+
+	// Breaking out must release the store.
+	if _, err := s.Has("/f0.txt"); err != nil {
+		t.Fatalf("Has after early break: %v", err)
+	}
+}
+
+func TestDuplicatesSeq(t *testing.T) {
+	s := openTest(t)
+
+	rows := []FileInfo{
+		{Path: "/x2", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "xx"},
+		{Path: "/a2", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "aa"},
+		{Path: "/x1", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "xx"},
+		{Path: "/lone", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "mm"},
+		{Path: "/a1", ModTime: time.Unix(1, 0), HashAlgo: "xxh3", Hash: "aa"},
+	}
+	for _, r := range rows {
+		if err := s.Upsert(r, false); err != nil {
+			t.Fatalf("Upsert %s: %v", r.Path, err)
+		}
+	}
+
+	var got [][]string
+	for group, err := range s.DuplicatesSeq("") {
+		if err != nil {
+			t.Fatalf("DuplicatesSeq: %v", err)
+		}
+		var paths []string
+		for _, c := range group.Copies {
+			paths = append(paths, c[0].Path)
+		}
+		got = append(got, paths)
+	}
+	want := "[[/a1 /a2] [/x1 /x2]]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("DuplicatesSeq groups = %v, want %s", got, want)
+	}
+}
+
+func TestDuplicatesCollapseHardlinks(t *testing.T) {
+	s := openTest(t)
+
+	rows := []FileInfo{
+		// /a and /b are links to one inode, /c is a second copy.
+		{Path: "/a", Size: 10, HashAlgo: "xxh3", Hash: "h1", Device: 1, Inode: 5, Nlink: 2},
+		{Path: "/b", Size: 10, HashAlgo: "xxh3", Hash: "h1", Device: 1, Inode: 5, Nlink: 2},
+		{Path: "/c", Size: 10, HashAlgo: "xxh3", Hash: "h1", Device: 1, Inode: 6, Nlink: 1},
+		// Already deduplicated: nothing to reclaim.
+		{Path: "/d", Size: 20, HashAlgo: "xxh3", Hash: "h2", Device: 1, Inode: 7, Nlink: 2},
+		{Path: "/e", Size: 20, HashAlgo: "xxh3", Hash: "h2", Device: 1, Inode: 7, Nlink: 2},
+		// The same inode number on another device is a different file.
+		{Path: "/f", Size: 30, HashAlgo: "xxh3", Hash: "h3", Device: 1, Inode: 8, Nlink: 1},
+		{Path: "/g", Size: 30, HashAlgo: "xxh3", Hash: "h3", Device: 2, Inode: 8, Nlink: 1},
+		// Unknown inodes (rows from older versions) are never collapsed.
+		{Path: "/h", Size: 40, HashAlgo: "xxh3", Hash: "h4"},
+		{Path: "/i", Size: 40, HashAlgo: "xxh3", Hash: "h4"},
+	}
+	for _, r := range rows {
+		r.ModTime = time.Unix(1, 0)
+		if err := s.Upsert(r, false); err != nil {
+			t.Fatalf("Upsert %s: %v", r.Path, err)
+		}
+	}
+
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	var got []string
+	for _, g := range groups {
+		var copies []string
+		for _, c := range g.Copies {
+			var links []string
+			for _, f := range c {
+				links = append(links, f.Path)
+			}
+			copies = append(copies, strings.Join(links, "="))
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%s", g.Hash, g.Reclaimable(), strings.Join(copies, ",")))
+	}
+	want := "[h1:10:/a=/b,/c h3:30:/f,/g h4:40:/h,/i]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("Duplicates = %v, want %s", got, want)
+	}
+	if n := groups[0].Copies[0][0].Nlink; n != 2 {
+		t.Fatalf("link count = %d, want 2", n)
+	}
+}
+
+func TestUpsertUpdatesOnMetadataChange(t *testing.T) {
+	s := openTest(t)
+
+	fi := FileInfo{Path: "/f", Size: 1, ModTime: time.Unix(1, 5), Inode: 7}
+	if err := s.Upsert(fi, false); err != nil {
+		t.Fatalf("Upsert insert: %v", err)
+	}
+	got, ok, err := s.Lookup("/f")
+	if err != nil || !ok {
+		t.Fatalf("Lookup: %v %v", ok, err)
+	}
+	if !got.ModTime.Equal(fi.ModTime) || got.Inode != 7 || !fi.Unchanged(got) {
+		t.Fatalf("Lookup = %+v, want %+v", got, fi)
+	}
+
+	fi.Size, fi.ModTime = 2, time.Unix(2, 0)
+	if err := s.Upsert(fi, false); err != nil {
+		t.Fatalf("Upsert update: %v", err)
+	}
+	got, _, _ = s.Lookup("/f")
+	if got.Size != 2 || !got.ModTime.Equal(fi.ModTime) {
+		t.Fatalf("metadata-only change not written: %+v", got)
+	}
+}
+
+func TestStatFieldsRoundTrip(t *testing.T) {
+	s := openTest(t)
+
+	fi := FileInfo{
+		Path:       "/bin/tool",
+		Size:       42,
+		ModTime:    time.Unix(100, 0),
+		Type:       TypeFile,
+		Mode:       0o4755,
+		UID:        1000,
+		GID:        100,
+		Inode:      1 << 63, // stored bit-for-bit in an int64 column
+		Device:     0xfd01,
+		Nlink:      3,
+		ChangeTime: time.Unix(200, 7),
+	}
+	if err := s.Upsert(fi, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	got, ok, err := s.Lookup(fi.Path)
+	if err != nil || !ok {
+		t.Fatalf("Lookup: %v %v", ok, err)
+	}
+	if !got.Equal(fi) {
+		t.Fatalf("Lookup = %+v, want %+v", got, fi)
+	}
+
+	// A metadata-only change, such as a chmod, is written.
+	fi.Mode = 0o755
+	if err := s.Upsert(fi, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if got, _, _ := s.Lookup(fi.Path); got.Mode != 0o755 {
+		t.Fatalf("mode = %v, want 0755", got.Mode)
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	tests := []struct {
+		mode fs.FileMode
+		want FileType
+	}{
+		{0o644, TypeFile},
+		{fs.ModeDir | 0o755, TypeDir},
+		{fs.ModeSymlink | 0o777, TypeSymlink},
+		{fs.ModeNamedPipe, TypeFIFO},
+		{fs.ModeSocket, TypeSocket},
+		{fs.ModeDevice, TypeDevice},
+		{fs.ModeDevice | fs.ModeCharDevice, TypeDevice},
+		{fs.ModeIrregular, TypeOther},
+	}
+	for _, tt := range tests {
+		if got := TypeOf(tt.mode); got != tt.want {
+			t.Errorf("TypeOf(%v) = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestSizeCollisions(t *testing.T) {
+	s := openTest(t)
+
+	rows := []FileInfo{
+		{Path: "/a", Size: 5, Type: TypeFile},
+		{Path: "/b", Size: 5, Type: TypeFile},
+		{Path: "/dir", Size: 5, Type: TypeDir}, // not a file: never a candidate
+		{Path: "/c", Size: 7, Type: TypeFile},  // unique size
+		{Path: "/e1", Type: TypeFile},          // empty files have no content to compare
+		{Path: "/e2", Type: TypeFile},
+	}
+	for _, r := range rows {
+		r.ModTime = time.Unix(1, 0)
+		if err := s.Upsert(r, false); err != nil {
+			t.Fatalf("Upsert %s: %v", r.Path, err)
+		}
+	}
+
+	var got [][]string
+	for group, err := range s.SizeCollisions() {
+		if err != nil {
+			t.Fatalf("SizeCollisions: %v", err)
+		}
+		var paths []string
+		for _, f := range group {
+			paths = append(paths, f.Path)
+		}
+		got = append(got, paths)
+	}
+	if want := "[[/a /b]]"; fmt.Sprint(got) != want {
+		t.Fatalf("SizeCollisions = %v, want %s", got, want)
+	}
+}
+
+func TestDuplicatesComparesOneAlgorithm(t *testing.T) {
+	s := openTest(t)
+
+	// The same digest string under two algorithms is not a match, and the
+	// algorithm most rows use is the one compared.
+	rows := []FileInfo{
+		{Path: "/a", HashAlgo: "sha256", Hash: "d1"},
+		{Path: "/b", HashAlgo: "sha256", Hash: "d1"},
+		{Path: "/c", HashAlgo: "sha256", Hash: "d2"},
+		{Path: "/x", HashAlgo: "md5", Hash: "d2"},
+		{Path: "/y", HashAlgo: "md5", Hash: "d3"},
+		{Path: "/z", HashAlgo: "md5", Hash: "d3"},
+	}
+	for _, r := range rows {
+		r.ModTime = time.Unix(1, 0)
+		if err := s.Upsert(r, false); err != nil {
+			t.Fatalf("Upsert %s: %v", r.Path, err)
+		}
+	}
+
+	algos, err := s.HashAlgos("")
+	if err != nil || algos["sha256"] != 3 || algos["md5"] != 3 {
+		t.Fatalf("HashAlgos = %v, %v; want 3 each", algos, err)
+	}
+	// A tie goes to the first name: md5.
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Algo != "md5" || groups[0].Hash != "d3" {
+		t.Fatalf("Duplicates = %+v, want the md5 group /y /z", groups)
+	}
+
+	if err := s.Upsert(FileInfo{Path: "/d", ModTime: time.Unix(1, 0), HashAlgo: "sha256", Hash: "d9"}, false); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if algo, err := s.DupAlgo(""); err != nil || algo != "sha256" {
+		t.Fatalf("DupAlgo = %q, %v; want sha256", algo, err)
+	}
+}
+
+func TestDuplicatesNeedSameSize(t *testing.T) {
+	s := openTest(t)
+
+	// /one and /two share a crc32 digest but not their size, so they cannot
+	// hold the same content; /three is a real copy of /one.
+	rows := []FileInfo{
+		{Path: "/one", Size: 18, HashAlgo: "crc32", Hash: "1b851995"},
+		{Path: "/two", Size: 14, HashAlgo: "crc32", Hash: "1b851995"},
+		{Path: "/three", Size: 18, HashAlgo: "crc32", Hash: "1b851995"},
+		{Path: "/four", Size: 14, HashAlgo: "crc32", Hash: "0000ffff"},
+	}
+	for _, r := range rows {
+		r.ModTime = time.Unix(1, 0)
+		if err := s.Upsert(r, false); err != nil {
+			t.Fatalf("Upsert %s: %v", r.Path, err)
+		}
+	}
+
+	groups, err := s.Duplicates("")
+	if err != nil {
+		t.Fatalf("Duplicates: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Size != 18 || len(groups[0].Copies) != 2 ||
+		groups[0].Copies[0][0].Path != "/one" || groups[0].Copies[1][0].Path != "/three" {
+		t.Fatalf("Duplicates = %+v, want only /one and /three", groups)
+	}
+}